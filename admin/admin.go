@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/wbor-fm/spinitron-proxy/cache"
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/clientkeys"
+)
+
+// API serves the authenticated /admin/ endpoints used to inspect and tune the
+// running proxy.
+type API struct {
+	// Bearer token that every request must present.
+	Token string
+	// The proxy's response cache.
+	Cache *cache.Cache
+	// Client API keys. Nil disables the /admin/keys routes.
+	Keys *clientkeys.Store
+}
+
+// Handler returns an http.Handler for every admin route. It should be mounted
+// at "/admin/".
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/ttl", a.getTTLs)
+	mux.HandleFunc("PUT /admin/ttl/default", a.putDefaultTTL)
+	mux.HandleFunc("PUT /admin/ttl/resource", a.putResourceTTL)
+	mux.HandleFunc("PUT /admin/ttl/collections/{name}", a.putCollectionTTL)
+	mux.HandleFunc("DELETE /admin/ttl/collections/{name}", a.deleteCollectionTTL)
+	mux.HandleFunc("PUT /admin/ttl/resources/{name}", a.putResourcesTTL)
+	mux.HandleFunc("DELETE /admin/ttl/resources/{name}", a.deleteResourcesTTL)
+
+	mux.HandleFunc("GET /admin/cache", a.listCache)
+	mux.HandleFunc("DELETE /admin/cache", a.flushCache)
+	mux.HandleFunc("GET /admin/cache/entry", a.getCacheEntry)
+	mux.HandleFunc("DELETE /admin/cache/entry", a.deleteCacheEntry)
+	mux.HandleFunc("DELETE /admin/cache/collections/{name}", a.deleteCacheCollection)
+
+	if a.Keys != nil {
+		mux.HandleFunc("GET /admin/keys", a.listKeys)
+		mux.HandleFunc("POST /admin/keys", a.createKey)
+		mux.HandleFunc("GET /admin/keys/{id}", a.getKey)
+		mux.HandleFunc("DELETE /admin/keys/{id}", a.revokeKey)
+	}
+
+	return a.requireToken(mux)
+}
+
+// requireToken rejects requests that don't carry "Authorization: Bearer
+// <token>" with the configured token.
+func (a *API) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		// Use constant-time comparison to prevent timing attacks.
+		if !ok || a.Token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(a.Token)) != 1 {
+			slog.WarnContext(r.Context(), "admin.unauthorized", "method", r.Method, "path", r.URL.Path,
+				"client_ip", clientip.FromRequest(r))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error body of the form {"error": "..."}.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,144 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
+	"github.com/wbor-fm/spinitron-proxy/cache"
+)
+
+// cacheEntry describes one cache entry in GET /admin/cache. Durations are
+// written as strings such as "30s".
+type cacheEntry struct {
+	Key        string `json:"key"`
+	Collection string `json:"collection"`
+	Status     int    `json:"status"`
+	// How long ago the entry was stored.
+	Age string `json:"age"`
+	// How long the entry stays fresh; zero once it is stale.
+	TTL   string `json:"ttl"`
+	Stale bool   `json:"stale"`
+	// Size of the body as stored, i.e. after compression.
+	Size     int    `json:"size"`
+	Encoding string `json:"encoding,omitempty"`
+	ETag     string `json:"etag"`
+}
+
+// cacheEntryDetail is the response body of GET /admin/cache/entry. Text
+// bodies are returned as-is in Body, anything else base64-encoded in
+// BodyBase64.
+type cacheEntryDetail struct {
+	cacheEntry
+	Header     http.Header `json:"header"`
+	StoredAt   time.Time   `json:"stored_at"`
+	Expires    time.Time   `json:"expires"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 []byte      `json:"body_base64,omitempty"`
+}
+
+func toCacheEntry(key string, e *cache.Entry, now time.Time) cacheEntry {
+	return cacheEntry{
+		Key:        key,
+		Collection: api.GetCollectionName(key),
+		Status:     e.StatusCode,
+		Age:        e.Age(now).Round(time.Millisecond).String(),
+		TTL:        e.MaxAge(now).Round(time.Millisecond).String(),
+		Stale:      !e.Fresh(now),
+		Size:       len(e.Body),
+		Encoding:   e.Encoding,
+		ETag:       e.ETag,
+	}
+}
+
+// GET /admin/cache lists every cached entry, sorted by key. The optional
+// ?collection= parameter limits the list to one collection.
+func (a *API) listCache(w http.ResponseWriter, r *http.Request) {
+	collection := r.URL.Query().Get("collection")
+	now := time.Now()
+
+	entries := []cacheEntry{}
+	a.Cache.Store.Range(func(k string, e *cache.Entry) bool {
+		if collection == "" || api.GetCollectionName(k) == collection {
+			entries = append(entries, toCacheEntry(k, e, now))
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+// GET /admin/cache/entry?key=... returns a single entry, including its
+// headers and uncompressed body. Keys are passed as a query parameter since
+// collection keys contain their own query string.
+func (a *API) getCacheEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "missing key parameter")
+		return
+	}
+
+	e, ok := a.Cache.Store.Get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not cached: "+key)
+		return
+	}
+
+	body, err := e.Identity()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	out := cacheEntryDetail{
+		cacheEntry: toCacheEntry(key, e, time.Now()),
+		Header:     e.Header,
+		StoredAt:   e.StoredAt,
+		Expires:    e.Expires,
+	}
+	if utf8.Valid(body) {
+		out.Body = string(body)
+	} else {
+		out.BodyBase64 = body
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// DELETE /admin/cache/entry?key=... purges a single entry.
+func (a *API) deleteCacheEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "missing key parameter")
+		return
+	}
+
+	if !a.Cache.Delete(key) {
+		writeError(w, http.StatusNotFound, "not cached: "+key)
+		return
+	}
+	slog.InfoContext(r.Context(), "admin.cache.purge", "key", key)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": 1})
+}
+
+// DELETE /admin/cache/collections/{name} purges a collection's pages along
+// with all of its individual resources.
+func (a *API) deleteCacheCollection(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	n := a.Cache.PurgeCollection(name)
+	slog.InfoContext(r.Context(), "admin.cache.purge", "collection", name, "count", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+// DELETE /admin/cache flushes the whole cache.
+func (a *API) flushCache(w http.ResponseWriter, r *http.Request) {
+	n := a.Cache.Flush()
+	slog.InfoContext(r.Context(), "admin.cache.flush", "count", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/cache"
+)
+
+const testToken = "secret"
+
+// newTestAPI returns an admin handler over a memory cache holding a few spins
+// and a show.
+func newTestAPI(t *testing.T) (http.Handler, *cache.Cache) {
+	t.Helper()
+	c := &cache.Cache{TTLs: cache.NewTTLPolicy(cache.TTLTable{Default: time.Minute})}
+	c.Init()
+	for _, key := range []string{"/api/spins", "/api/spins?page=2", "/api/spins/1", "/api/shows/7"} {
+		c.Set(key, &cache.Entry{Body: []byte(`{"key":"` + key + `"}`)})
+	}
+	return (&API{Token: testToken, Cache: c}).Handler(), c
+}
+
+// do performs an authenticated admin request and decodes the JSON response
+// into out, if given.
+func do(t *testing.T, h http.Handler, method, target string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, target, rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestCacheRequiresToken(t *testing.T) {
+	h, _ := newTestAPI(t)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/cache", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated flush: status %d; want 401", rec.Code)
+	}
+}
+
+func TestListCache(t *testing.T) {
+	h, _ := newTestAPI(t)
+
+	var list struct {
+		Count   int          `json:"count"`
+		Entries []cacheEntry `json:"entries"`
+	}
+	if code := do(t, h, "GET", "/admin/cache?collection=spins", &list); code != http.StatusOK {
+		t.Fatalf("status %d; want 200", code)
+	}
+	if list.Count != 3 || len(list.Entries) != 3 {
+		t.Fatalf("listed %d spins entries; want 3", list.Count)
+	}
+	first := list.Entries[0]
+	if first.Key != "/api/spins" || first.Collection != "spins" || first.Stale || first.Size == 0 {
+		t.Errorf("first entry = %+v", first)
+	}
+}
+
+func TestGetAndDeleteCacheEntry(t *testing.T) {
+	h, c := newTestAPI(t)
+
+	var entry cacheEntryDetail
+	if code := do(t, h, "GET", "/admin/cache/entry?key=/api/shows/7", &entry); code != http.StatusOK {
+		t.Fatalf("GET entry: status %d; want 200", code)
+	}
+	if entry.Body != `{"key":"/api/shows/7"}` {
+		t.Errorf("entry body = %q", entry.Body)
+	}
+
+	if code := do(t, h, "DELETE", "/admin/cache/entry?key=/api/shows/7", nil); code != http.StatusOK {
+		t.Fatalf("DELETE entry: status %d; want 200", code)
+	}
+	if _, ok := c.Get("/api/shows/7"); ok {
+		t.Error("/api/shows/7 still cached after being purged")
+	}
+	if code := do(t, h, "DELETE", "/admin/cache/entry?key=/api/shows/7", nil); code != http.StatusNotFound {
+		t.Errorf("second DELETE entry: status %d; want 404", code)
+	}
+}
+
+func TestPurgeCollectionAndFlush(t *testing.T) {
+	h, c := newTestAPI(t)
+
+	var purged map[string]int
+	do(t, h, "DELETE", "/admin/cache/collections/spins", &purged)
+	if purged["purged"] != 3 {
+		t.Errorf("purged %d spins entries; want 3", purged["purged"])
+	}
+	if _, ok := c.Get("/api/spins/1"); ok {
+		t.Error("/api/spins/1 still cached after purging its collection")
+	}
+	if _, ok := c.Get("/api/shows/7"); !ok {
+		t.Error("purging spins removed /api/shows/7")
+	}
+
+	do(t, h, "DELETE", "/admin/cache", &purged)
+	if purged["purged"] != 1 || c.Len() != 0 {
+		t.Errorf("flush purged %d, left %d entries; want 1, 0", purged["purged"], c.Len())
+	}
+}
@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/clientkeys"
+)
+
+// clientKey is the JSON form of a clientkeys.Key, without its secret hash.
+type clientKey struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Collections []string          `json:"collections,omitempty"`
+	Tier        string            `json:"tier,omitempty"`
+	RateLimit   *clientkeys.Limit `json:"rate_limit,omitempty"`
+	Active      bool              `json:"active"`
+	Created     time.Time         `json:"created"`
+	Revoked     *time.Time        `json:"revoked,omitempty"`
+	Usage       clientkeys.Usage  `json:"usage"`
+}
+
+// newKeyBody is the request body for POST /admin/keys.
+type newKeyBody struct {
+	Name        string            `json:"name"`
+	Collections []string          `json:"collections"`
+	Tier        string            `json:"tier"`
+	RateLimit   *clientkeys.Limit `json:"rate_limit"`
+}
+
+func toClientKey(k clientkeys.Key) clientKey {
+	return clientKey{
+		ID:          k.ID,
+		Name:        k.Name,
+		Collections: k.Collections,
+		Tier:        k.Tier,
+		RateLimit:   k.RateLimit,
+		Active:      k.Active(),
+		Created:     k.Created,
+		Revoked:     k.Revoked,
+		Usage:       k.Usage,
+	}
+}
+
+// GET /admin/keys lists every client key, including revoked ones.
+func (a *API) listKeys(w http.ResponseWriter, r *http.Request) {
+	keys := a.Keys.List()
+	out := make([]clientKey, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, toClientKey(k))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"count": len(out), "keys": out})
+}
+
+// POST /admin/keys issues a new key. The response is the only time its
+// secret is shown.
+func (a *API) createKey(w http.ResponseWriter, r *http.Request) {
+	var body newKeyBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if l := body.RateLimit; l != nil {
+		if l.MaxRequests <= 0 || l.Window.Duration <= 0 {
+			writeError(w, http.StatusBadRequest, "rate_limit needs a positive max_requests and window")
+			return
+		}
+		if l.GroupBy != "" && !l.GroupBy.Valid() {
+			writeError(w, http.StatusBadRequest, "rate_limit.group_by must be one of ip, ip_path, ip_collection, global")
+			return
+		}
+	}
+
+	k, secret, err := a.Keys.Create(clientkeys.Key{
+		Name:        body.Name,
+		Collections: body.Collections,
+		Tier:        body.Tier,
+		RateLimit:   body.RateLimit,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "admin.keys.create failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "could not save the key")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin.keys.create", "key_id", k.ID, "name", k.Name)
+	writeJSON(w, http.StatusCreated, struct {
+		clientKey
+		Secret string `json:"secret"`
+	}{toClientKey(k), secret})
+}
+
+// GET /admin/keys/{id} returns a single key and its usage.
+func (a *API) getKey(w http.ResponseWriter, r *http.Request) {
+	k, ok := a.Keys.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such key")
+		return
+	}
+	writeJSON(w, http.StatusOK, toClientKey(k))
+}
+
+// DELETE /admin/keys/{id} revokes a key. Requests made with it are refused
+// from then on.
+func (a *API) revokeKey(w http.ResponseWriter, r *http.Request) {
+	k, err := a.Keys.Revoke(r.PathValue("id"))
+	switch {
+	case errors.Is(err, clientkeys.ErrNotFound):
+		writeError(w, http.StatusNotFound, "no such key")
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "admin.keys.revoke failed", "error", err)
+		writeError(w, http.StatusInternalServerError, "could not save the key")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin.keys.revoke", "key_id", k.ID, "name", k.Name)
+	writeJSON(w, http.StatusOK, toClientKey(k))
+}
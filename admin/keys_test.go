@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wbor-fm/spinitron-proxy/clientkeys"
+)
+
+func TestClientKeys(t *testing.T) {
+	keys, err := clientkeys.Open(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	h := (&API{Token: testToken, Keys: keys}).Handler()
+
+	// post makes an authenticated POST /admin/keys with the given body.
+	post := func(body string, out any) int {
+		req := httptest.NewRequest("POST", "/admin/keys", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if out != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+		}
+		return rec.Code
+	}
+
+	if code := post(`{"collections": ["spins"]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("create without a name: status %d; want 400", code)
+	}
+	if code := post(`{"name": "app", "rate_limit": {"max_requests": 10, "window": "soon"}}`, nil); code != http.StatusBadRequest {
+		t.Errorf("create with a bad window: status %d; want 400", code)
+	}
+
+	var created struct {
+		clientKey
+		Secret string `json:"secret"`
+	}
+	body := `{"name": "mobile app", "collections": ["spins", "shows"], "rate_limit": {"max_requests": 120, "window": "1m"}}`
+	if code := post(body, &created); code != http.StatusCreated {
+		t.Fatalf("create: status %d; want 201", code)
+	}
+	if created.Secret == "" || created.ID == "" || !created.Active || created.RateLimit.Window.String() != "1m0s" {
+		t.Errorf("create = %+v; want an active key with a secret and a 1m window", created)
+	}
+
+	var list struct {
+		Count int         `json:"count"`
+		Keys  []clientKey `json:"keys"`
+	}
+	do(t, h, "GET", "/admin/keys", &list)
+	if list.Count != 1 || list.Keys[0].Name != "mobile app" {
+		t.Errorf("list = %+v; want the mobile app key", list)
+	}
+
+	var revoked clientKey
+	if code := do(t, h, "DELETE", "/admin/keys/"+created.ID, &revoked); code != http.StatusOK {
+		t.Fatalf("revoke: status %d; want 200", code)
+	}
+	if revoked.Active || revoked.Revoked == nil {
+		t.Errorf("revoke = %+v; want an inactive key with a revocation time", revoked)
+	}
+	if code := do(t, h, "GET", "/admin/keys/nope", nil); code != http.StatusNotFound {
+		t.Errorf("get unknown key: status %d; want 404", code)
+	}
+}
@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/cache"
+)
+
+// ttlTable is the JSON form of cache.TTLTable, with durations written as
+// strings such as "30s".
+type ttlTable struct {
+	Default     string            `json:"default"`
+	Resource    string            `json:"resource"`
+	Collections map[string]string `json:"collections"`
+	Resources   map[string]string `json:"resources"`
+}
+
+// ttlBody is the request body for every PUT /admin/ttl/... route.
+type ttlBody struct {
+	TTL string `json:"ttl"`
+}
+
+func toTTLTable(t cache.TTLTable) ttlTable {
+	out := ttlTable{
+		Default:     t.Default.String(),
+		Resource:    t.Resource.String(),
+		Collections: make(map[string]string, len(t.Collections)),
+		Resources:   make(map[string]string, len(t.Resources)),
+	}
+	for k, v := range t.Collections {
+		out.Collections[k] = v.String()
+	}
+	for k, v := range t.Resources {
+		out.Resources[k] = v.String()
+	}
+	return out
+}
+
+// GET /admin/ttl returns the current TTL table.
+func (a *API) getTTLs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, toTTLTable(a.Cache.TTLs.Table()))
+}
+
+// PUT /admin/ttl/default sets the fallback TTL.
+func (a *API) putDefaultTTL(w http.ResponseWriter, r *http.Request) {
+	a.putTTL(w, r, "default", a.Cache.TTLs.SetDefault)
+}
+
+// PUT /admin/ttl/resource sets the fallback TTL for individual resources.
+func (a *API) putResourceTTL(w http.ResponseWriter, r *http.Request) {
+	a.putTTL(w, r, "resource", a.Cache.TTLs.SetResourceDefault)
+}
+
+// PUT /admin/ttl/collections/{name} sets a collection's TTL.
+func (a *API) putCollectionTTL(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a.putTTL(w, r, "collections."+name, func(ttl time.Duration) {
+		a.Cache.TTLs.SetCollection(name, ttl)
+	})
+}
+
+// DELETE /admin/ttl/collections/{name} makes a collection use the default.
+func (a *API) deleteCollectionTTL(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a.Cache.TTLs.DeleteCollection(name)
+	slog.InfoContext(r.Context(), "admin.ttl.delete", "setting", "collections."+name)
+	writeJSON(w, http.StatusOK, toTTLTable(a.Cache.TTLs.Table()))
+}
+
+// PUT /admin/ttl/resources/{name} sets the TTL for a collection's resources.
+func (a *API) putResourcesTTL(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a.putTTL(w, r, "resources."+name, func(ttl time.Duration) {
+		a.Cache.TTLs.SetResource(name, ttl)
+	})
+}
+
+// DELETE /admin/ttl/resources/{name} makes a collection's resources use the
+// resource default.
+func (a *API) deleteResourcesTTL(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a.Cache.TTLs.DeleteResource(name)
+	slog.InfoContext(r.Context(), "admin.ttl.delete", "setting", "resources."+name)
+	writeJSON(w, http.StatusOK, toTTLTable(a.Cache.TTLs.Table()))
+}
+
+// putTTL decodes a {"ttl": "..."} body, passes the duration to set, and
+// responds with the updated table.
+func (a *API) putTTL(w http.ResponseWriter, r *http.Request, what string, set func(time.Duration)) {
+	var body ttlBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	ttl, err := time.ParseDuration(body.TTL)
+	if err != nil || ttl < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must be a non-negative duration such as \"30s\"")
+		return
+	}
+
+	set(ttl)
+	slog.InfoContext(r.Context(), "admin.ttl.set", "setting", what, "ttl", ttl)
+	writeJSON(w, http.StatusOK, toTTLTable(a.Cache.TTLs.Table()))
+}
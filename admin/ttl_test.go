@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putTTL performs an authenticated PUT with the given JSON body and decodes
+// the response into out, if given.
+func putTTL(t *testing.T, h http.Handler, target, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest("PUT", target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("PUT %s: decoding %q: %v", target, rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestTTLRequiresToken(t *testing.T) {
+	h, c := newTestAPI(t)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/admin/ttl", nil),
+		httptest.NewRequest("PUT", "/admin/ttl/default", strings.NewReader(`{"ttl": "1s"}`)),
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("unauthenticated %s %s: status %d; want 401", req.Method, req.URL, rec.Code)
+		}
+	}
+	if got := c.TTLs.TTL("/api/spins"); got != time.Minute {
+		t.Errorf("TTL after unauthenticated PUT = %v; want 1m", got)
+	}
+}
+
+func TestGetTTLs(t *testing.T) {
+	h, c := newTestAPI(t)
+	c.TTLs.SetCollection("spins", 30*time.Second)
+
+	var table ttlTable
+	if code := do(t, h, "GET", "/admin/ttl", &table); code != http.StatusOK {
+		t.Fatalf("status %d; want 200", code)
+	}
+	if table.Default != "1m0s" || table.Collections["spins"] != "30s" {
+		t.Errorf("table = %+v; want default 1m0s and spins 30s", table)
+	}
+}
+
+func TestPutTTL(t *testing.T) {
+	h, c := newTestAPI(t)
+
+	tests := []struct {
+		target string
+		ttl    string
+		key    string // whose TTL the setting decides
+		want   time.Duration
+	}{
+		{"/admin/ttl/collections/spins", "30s", "/api/spins?page=2", 30 * time.Second},
+		{"/admin/ttl/resources/spins", "2h", "/api/spins/1", 2 * time.Hour},
+		{"/admin/ttl/resource", "1h", "/api/shows/7", time.Hour},
+		{"/admin/ttl/default", "5m", "/api/playlists", 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		var table ttlTable
+		if code := putTTL(t, h, tt.target, `{"ttl": "`+tt.ttl+`"}`, &table); code != http.StatusOK {
+			t.Errorf("PUT %s: status %d; want 200", tt.target, code)
+			continue
+		}
+		if got := c.TTLs.TTL(tt.key); got != tt.want {
+			t.Errorf("after PUT %s, TTL(%s) = %v; want %v", tt.target, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPutTTLRejectsBadDurations(t *testing.T) {
+	h, c := newTestAPI(t)
+
+	for _, body := range []string{`{"ttl": "soon"}`, `{"ttl": "-1s"}`, `{"ttl": ""}`, `not json`} {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if code := putTTL(t, h, "/admin/ttl/collections/spins", body, &e); code != http.StatusBadRequest || e.Error == "" {
+			t.Errorf("PUT %s: status %d, error %q; want 400 with an error", body, code, e.Error)
+		}
+	}
+	if got := c.TTLs.TTL("/api/spins"); got != time.Minute {
+		t.Errorf("TTL after rejected PUTs = %v; want 1m", got)
+	}
+}
+
+func TestDeleteTTL(t *testing.T) {
+	h, c := newTestAPI(t)
+	c.TTLs.SetCollection("spins", 30*time.Second)
+	c.TTLs.SetResource("spins", 2*time.Hour)
+
+	var table ttlTable
+	if code := do(t, h, "DELETE", "/admin/ttl/collections/spins", &table); code != http.StatusOK {
+		t.Fatalf("DELETE collection: status %d; want 200", code)
+	}
+	if _, ok := table.Collections["spins"]; ok {
+		t.Errorf("table after DELETE still has spins: %+v", table)
+	}
+	if got := c.TTLs.TTL("/api/spins"); got != time.Minute {
+		t.Errorf("TTL(/api/spins) after DELETE = %v; want the default 1m", got)
+	}
+
+	if code := do(t, h, "DELETE", "/admin/ttl/resources/spins", nil); code != http.StatusOK {
+		t.Fatalf("DELETE resources: status %d; want 200", code)
+	}
+	if got := c.TTLs.TTL("/api/spins/1"); got != time.Minute {
+		t.Errorf("TTL(/api/spins/1) after DELETE = %v; want the default 1m", got)
+	}
+}
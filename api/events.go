@@ -0,0 +1,70 @@
+package api
+
+import "encoding/json"
+
+// EventCollections maps the types of events sent to SSE clients to the
+// collection whose changes each reports.
+var EventCollections = map[string]string{
+	"spin":     "spins",
+	"playlist": "playlists",
+	"show":     "shows",
+}
+
+// Playlist is a playlist (a DJ's set, or automation) as returned by
+// Spinitron's /api/playlists, with the fields downstream consumers care
+// about.
+type Playlist struct {
+	ID          int64  `json:"id"`
+	PersonaID   int64  `json:"persona_id"`
+	ShowID      int64  `json:"show_id"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Duration    int    `json:"duration"`
+	Timezone    string `json:"timezone,omitempty"`
+	Category    string `json:"category,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Automation  bool   `json:"automation"`
+	EpisodeName string `json:"episode_name,omitempty"`
+}
+
+// Show is a scheduled show as returned by Spinitron's /api/shows, with the
+// fields downstream consumers care about.
+type Show struct {
+	ID          int64  `json:"id"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Duration    int    `json:"duration"`
+	Timezone    string `json:"timezone,omitempty"`
+	OneOff      bool   `json:"one_off"`
+	Category    string `json:"category,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+// ParsePlaylists returns the playlists in a /api/playlists response body,
+// newest first as Spinitron lists them, so the first is the current one.
+func ParsePlaylists(body []byte) ([]Playlist, error) {
+	return parseItems[Playlist](body)
+}
+
+// ParseShows returns the shows in a /api/shows response body, in schedule
+// order starting with the one on air.
+func ParseShows(body []byte) ([]Show, error) {
+	return parseItems[Show](body)
+}
+
+// parseItems returns the items array of a collection response body.
+func parseItems[T any](body []byte) ([]T, error) {
+	var page struct {
+		Items []T `json:"items"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, err
+	}
+	return page.Items, nil
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Spin is a single spin (a song played) as returned by Spinitron's /api/spins,
+// with the fields downstream consumers care about. Times are kept as
+// Spinitron sends them, e.g. "2024-05-01T14:03:00+0000".
+type Spin struct {
+	ID         int64  `json:"id"`
+	PlaylistID int64  `json:"playlist_id"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+	Duration   int    `json:"duration"`
+	Timezone   string `json:"timezone,omitempty"`
+	Image      string `json:"image,omitempty"`
+	Artist     string `json:"artist"`
+	Composer   string `json:"composer,omitempty"`
+	Release    string `json:"release,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Genre      string `json:"genre,omitempty"`
+	Song       string `json:"song"`
+	Note       string `json:"note,omitempty"`
+	Request    bool   `json:"request"`
+	Local      bool   `json:"local"`
+	New        bool   `json:"new"`
+	ISRC       string `json:"isrc,omitempty"`
+}
+
+// ParseSpins returns the spins in a /api/spins response body, newest first
+// as Spinitron lists them.
+func ParseSpins(body []byte) ([]Spin, error) {
+	return parseItems[Spin](body)
+}
+
+// NewerSpins returns the spins with an ID above lastID, oldest first.
+func NewerSpins(spins []Spin, lastID int64) []Spin {
+	var out []Spin
+	for _, s := range spins {
+		if s.ID > lastID {
+			out = append(out, s)
+		}
+	}
+	slices.SortFunc(out, func(a, b Spin) int { return cmp.Compare(a.ID, b.ID) })
+	return out
+}
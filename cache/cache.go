@@ -1,79 +1,165 @@
 package cache
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/wbor-fm/spinitron-proxy/api"
-	"github.com/Yiling-J/theine-go"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
 )
 
 // MAX_CACHE_SIZE determines the maximum number of cache entries that can be
-// stored at once.
+// stored at once, unless MaxSize is set.
 const MAX_CACHE_SIZE = 2000
 
-// Cache wraps a theine.Cache for storing []byte responses keyed by string.
-// Theine is a simple, thread-safe, in-memory cache library. It is used here
-// to store responses from the Spinitron API.
+// Cache stores responses from the Spinitron API keyed by string, deciding how
+// long each one lives and invalidating whole collections together. Where the
+// entries are kept is up to its Store.
 type Cache struct {
-	tcache *theine.Cache[string, []byte] // Underlying cache from theine-go library.
+	// Storage backend. Nil means an in-memory store of MaxSize entries.
+	Store Store
+	// Maximum number of entries for the default in-memory store. Zero means
+	// MAX_CACHE_SIZE.
+	MaxSize int
+	// Upstream response headers stored with each entry. Empty means
+	// DefaultHeaders.
+	Headers []string
+	// Content coding used to store compressible bodies: EncodingGzip,
+	// EncodingBrotli, or EncodingIdentity to store them as-is.
+	Compression string
+	// Decides how long each entry stays fresh. Nil means nothing is cached.
+	TTLs *TTLPolicy
+	// How long after expiry an entry may still be served while it is
+	// refreshed in the background (stale-while-revalidate).
+	StaleWhileRevalidate time.Duration
+	// How long after expiry an entry may still be served when the upstream
+	// fails (stale-if-error).
+	StaleIfError time.Duration
+
+	initialized bool
 }
 
-// Initializes the theine cache
+// Initializes the cache and its store.
 func (c *Cache) Init() {
-	// If tcache is already set, return immediately and do nothing.
-	if c.tcache != nil {
+	// If already initialized, return immediately and do nothing.
+	if c.initialized {
 		return
 	}
+	c.initialized = true
 
-	// Build a theine cache with our maximum size. Provide a RemovalListener
-	// to remove all related items from the cache when a collection path expires.
-	cache, err := theine.NewBuilder[string, []byte](MAX_CACHE_SIZE).RemovalListener(func(k string, v []byte, r theine.RemoveReason) {
-		// RemovalListener is called whenever an item is removed from the cache.
-		// We're interested in the RemoveReason, which tells us why the item was
-		// removed. We only care about expired items here.
-
-		// When a collection path expires, we also want to remove all associated
-		// resources in that collection.
-		if api.IsCollectionPath(k) && r == theine.EXPIRED {
-			c.evictCollection(api.GetCollectionName(k))
-		}
-	}).Build()
+	if c.TTLs == nil {
+		c.TTLs = NewTTLPolicy(TTLTable{})
+	}
 
-	if err != nil {
-		// If building the cache fails, panic to crash early.
-		panic(err)
+	if len(c.Headers) == 0 {
+		c.Headers = DefaultHeaders
+	}
+
+	if c.Store == nil {
+		size := c.MaxSize
+		if size <= 0 {
+			size = MAX_CACHE_SIZE
+		}
+		c.Store = NewMemoryStore(size)
 	}
 
-	// Assign the newly created cache to our struct.
-	c.tcache = cache
+	// When a collection path expires (which happens once its grace window is
+	// over, see Set), we also want to remove all associated resources in that
+	// collection.
+	c.Store.OnExpire(func(k string) {
+		metrics.CacheEvictions.WithLabelValues(metrics.Collection(k), "expired").Inc()
+		if api.IsCollectionPath(k) {
+			c.evictCollection(api.GetCollectionName(k), "collection")
+		}
+	})
+}
+
+// Close releases the cache's store.
+func (c *Cache) Close() error {
+	return c.Store.Close()
 }
 
-// Get retrieves a value from the cache by key. It returns the value (if found)
-// and a boolean to indicate whether the key was present in the cache.
-func (c *Cache) Get(key string) ([]byte, bool) {
+// Get retrieves an entry from the cache by key. It returns the entry (if
+// found) and a boolean to indicate whether the key was present in the cache.
+// The entry may be stale; check Entry.Fresh before serving it as-is.
+func (c *Cache) Get(key string) (*Entry, bool) {
 	tick := time.Now()
-	x, y := c.tcache.Get(key)
-	log.Println("cache.get", time.Since(tick), key)
+	x, y := c.Store.Get(key)
+
+	result := "miss"
+	if y {
+		result = "hit"
+		if !x.Fresh(tick) {
+			result = "stale"
+		}
+	}
+	metrics.CacheLookups.WithLabelValues(metrics.Collection(key), result).Inc()
+	slog.Debug("cache.get", "key", key, "collection", api.GetCollectionName(key),
+		"result", result, "duration", time.Since(tick))
 	return x, y
 }
 
 // Set adds a new key-value pair to the cache with a time-to-live determined by
-// getTTL(key) (defined below). Returns true if set was successful.
+// the TTL policy. Returns true if set was successful. Keys whose TTL is zero
+// are not cached and return false.
+// Even if it isn't cached, the entry is prepared for serving: its headers are
+// reduced to the allowed Headers, its ETag, StoredAt and Expires are filled
+// in, its body is compressed per Compression and its status code defaults to
+// 200.
 // If setting to a key that already exists, the value is updated and the TTL is
-// reset (done by the theine library).
-func (c *Cache) Set(key string, value []byte) bool {
+// reset.
+func (c *Cache) Set(key string, entry *Entry) bool {
+	if entry.StatusCode == 0 {
+		entry.StatusCode = http.StatusOK
+	}
+	entry.Header = filterHeaders(entry.Header, c.Headers)
+	entry.ETag = makeETag(entry.Body)
+	c.compress(key, entry)
+
 	tick := time.Now()
-	// Theine supports setting entries with a TTL.
-	// The '1' argument is for cost (weight) of the entry, used for cache
-	// eviction strategies. We don't use it here, so it's set to 1 for all
-	// entries.
-	res := c.tcache.SetWithTTL(key, value, 1, getTTL(key))
-	log.Println("cache.set", time.Since(tick), key)
+	entry.StoredAt = tick
+	entry.Expires = tick
+
+	ttl := c.TTLs.TTL(key)
+	if ttl <= 0 {
+		slog.Debug("cache.nottl", "key", key)
+		return false
+	}
+	entry.Expires = tick.Add(ttl)
+
+	// The entry is kept for its TTL plus the grace window, so that it can
+	// still be served stale.
+	res := c.Store.Set(key, entry, ttl+c.grace())
+	slog.Debug("cache.set", "key", key, "collection", api.GetCollectionName(key),
+		"ttl", ttl, "duration", time.Since(tick))
 	return res
 }
 
+// compress replaces a compressible entry's body with its Compression-encoded
+// form, unless that wouldn't make it smaller.
+func (c *Cache) compress(key string, entry *Entry) {
+	if c.Compression == EncodingIdentity || entry.Encoding != EncodingIdentity ||
+		len(entry.Body) < minCompressSize || !compressible(entry.Header.Get("Content-Type")) {
+		return
+	}
+
+	z, err := compress(c.Compression, entry.Body)
+	if err != nil {
+		slog.Warn("cache.compress failed", "key", key, "error", err)
+		return
+	}
+	if len(z) < len(entry.Body) {
+		entry.Body = z
+		entry.Encoding = c.Compression
+	}
+}
+
+// grace returns how long entries are kept after they expire.
+func (c *Cache) grace() time.Duration {
+	return max(c.StaleWhileRevalidate, c.StaleIfError)
+}
+
 // MakeCacheKey uses request info to build a consistent cache key. If the path
 // is a "collection path," it appends the query parameters.
 func (c *Cache) MakeCacheKey(req *http.Request) string {
@@ -98,44 +184,75 @@ func (c *Cache) MakeCacheKey(req *http.Request) string {
 	return result
 }
 
-// getTTL defines how long each type of endpoint is cached. Resource paths and
-// collection paths have different time durations.
-func getTTL(key string) time.Duration {
-	// If it's a resource path, we cache for 3 minutes.
-	if api.IsResourcePath(key) {
-		return 3 * time.Minute
-	}
+// evictCollection removes all cached entries from a specific collection.
+// This is called when a collection item is removed due to expiration, and by
+// PurgeCollection. It returns how many entries matched, and a channel that is
+// closed once they have all been deleted. reason is recorded in the evictions
+// metric.
+func (c *Cache) evictCollection(name, reason string) (int, <-chan struct{}) {
+	tick := time.Now()
+	// Range over every key in the cache and collect the ones that belong to
+	// the same collection name.
+	var keys []string
+	c.Store.Range(func(k string, v *Entry) bool {
+		if api.GetCollectionName(k) == name {
+			keys = append(keys, k)
+		}
+		return true
+	})
 
-	// Otherwise, get the collection name and look up its specific TTL.
-	c := api.GetCollectionName(key)
+	// The deletes happen in a goroutine (go keyword), since this may be
+	// running inside the store's own expiry callback, which can't modify the
+	// store without deadlocking.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, k := range keys {
+			c.Store.Delete(k)
+			metrics.CacheEvictions.WithLabelValues(metrics.Collection(k), reason).Inc()
+		}
+	}()
+	slog.Info("cache.evicting", "collection", name, "reason", reason,
+		"count", len(keys), "duration", time.Since(tick))
+	return len(keys), done
+}
 
-	var ttl = map[string]time.Duration{
-		"personas":  5 * time.Minute,
-		"shows":     5 * time.Minute,
-		"playlists": 3 * time.Minute,
-		"spins":     30 * time.Second,
+// Delete removes key from the cache, reporting whether it was there.
+func (c *Cache) Delete(key string) bool {
+	if _, ok := c.Store.Get(key); !ok {
+		return false
 	}
+	c.Store.Delete(key)
+	metrics.CacheEvictions.WithLabelValues(metrics.Collection(key), "purged").Inc()
+	slog.Info("cache.delete", "key", key)
+	return true
+}
 
-	return ttl[c]
+// PurgeCollection removes every entry of the named collection (e.g. "spins"),
+// both the collection pages and its individual resources, and returns how
+// many were removed.
+func (c *Cache) PurgeCollection(name string) int {
+	n, done := c.evictCollection(name, "purged")
+	<-done
+	return n
 }
 
-// evictCollection removes all cached entries from a specific collection.
-// This is called when a collection item is removed due to expiration.
-func (c *Cache) evictCollection(name string) {
-	tick := time.Now()
-	// Range over every key in the cache. If the key belongs to the same
-	// collection name, delete that entry. This is done concurrently via a
-	// goroutine (go keyword).
-	c.tcache.Range(func(k string, v []byte) bool {
-		if api.GetCollectionName(k) == name {
-			go c.tcache.Delete(k)
-		}
+// Flush removes every entry from the cache and returns how many were removed.
+func (c *Cache) Flush() int {
+	var keys []string
+	c.Store.Range(func(k string, v *Entry) bool {
+		keys = append(keys, k)
 		return true
 	})
-	log.Println("cache.evicting", time.Since(tick), name)
+	for _, k := range keys {
+		c.Store.Delete(k)
+		metrics.CacheEvictions.WithLabelValues(metrics.Collection(k), "flushed").Inc()
+	}
+	slog.Info("cache.flush", "count", len(keys))
+	return len(keys)
 }
 
 // Len returns the current number of entries in the cache.
 func (c *Cache) Len() int {
-	return c.tcache.Len()
+	return c.Store.Len()
 }
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/atomicfile"
+)
+
+// DiskStore is a Store that keeps entries in memory and writes each one
+// through to its own file in a directory, so the cache survives restarts.
+// Reads are served from memory; the files are only read back when the store
+// is opened.
+type DiskStore struct {
+	*MemoryStore
+	dir string
+
+	// Held while a key's entry is updated in memory and on disk, so that
+	// concurrent writes to one key leave the same entry in both. Keys share
+	// locks by hash.
+	keyLocks [64]sync.Mutex
+}
+
+// diskRecord is the on-disk form of one entry.
+type diskRecord struct {
+	Key   string `json:"key"`
+	Entry *Entry `json:"entry"`
+	// When the store should drop the entry, i.e. the end of its grace window.
+	RemoveAt time.Time `json:"remove_at"`
+}
+
+// OpenDiskStore opens (creating it if needed) a DiskStore in dir holding at
+// most size entries. Entries left by a previous run are restored with their
+// remaining TTL; files for entries that have since expired are removed.
+func OpenDiskStore(dir string, size int) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+
+	s := &DiskStore{MemoryStore: NewMemoryStore(size), dir: dir}
+
+	// Remove an entry's file once theine expires or evicts it, unless it has
+	// already been replaced by a newer entry under the same key.
+	s.onDrop = func(key string, e *Entry) {
+		if current, ok := s.MemoryStore.Get(key); ok && current != e {
+			return
+		}
+		s.removeFile(key)
+	}
+
+	if err := s.load(); err != nil {
+		s.MemoryStore.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load restores every unexpired entry from the directory into memory.
+func (s *DiskStore) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("cache: %w", err)
+	}
+
+	now := time.Now()
+	restored := 0
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cache: %w", err)
+		}
+
+		var rec diskRecord
+		if err := json.Unmarshal(data, &rec); err != nil || rec.Entry == nil {
+			// A torn write or a file we don't understand. It's only a
+			// cache, so drop it rather than refusing to start.
+			slog.Warn("cache.disk.corrupt", "path", path)
+			_ = os.Remove(path)
+			continue
+		}
+
+		remaining := rec.RemoveAt.Sub(now)
+		if remaining <= 0 {
+			_ = os.Remove(path)
+			continue
+		}
+
+		s.MemoryStore.Set(rec.Key, rec.Entry, remaining)
+		restored++
+	}
+
+	slog.Info("cache.disk.restored", "count", restored, "dir", s.dir)
+	return nil
+}
+
+// Set stores the entry in memory and writes it to disk.
+func (s *DiskStore) Set(key string, e *Entry, ttl time.Duration) bool {
+	mu := s.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !s.MemoryStore.Set(key, e, ttl) {
+		return false
+	}
+
+	data, err := json.Marshal(diskRecord{Key: key, Entry: e, RemoveAt: time.Now().Add(ttl)})
+	if err == nil {
+		err = atomicfile.Write(s.path(key), data)
+	}
+	if err != nil {
+		// The entry is still usable from memory; it just won't survive a
+		// restart.
+		slog.Error("cache.disk.write failed", "key", key, "error", err)
+	}
+	return true
+}
+
+// Delete removes the entry from memory and disk.
+func (s *DiskStore) Delete(key string) {
+	mu := s.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	s.MemoryStore.Delete(key)
+	s.removeFile(key)
+}
+
+// keyLock returns the lock guarding key.
+func (s *DiskStore) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.keyLocks[h.Sum32()%uint32(len(s.keyLocks))]
+}
+
+// path returns the file used for key. Keys contain slashes and query strings,
+// so they are hashed into a safe file name.
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *DiskStore) removeFile(key string) {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("cache.disk.remove failed", "key", key, "error", err)
+	}
+}
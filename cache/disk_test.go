@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Checks that entries written by one DiskStore are restored, with their
+// remaining TTL, by the next one opened on the same directory.
+func TestDiskStoreRestoresEntries(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.Set("/api/spins", &Entry{Body: []byte("spins"), StoredAt: now, Expires: now.Add(time.Minute)}, time.Minute)
+	s.Set("/api/shows", &Entry{Body: []byte("shows"), StoredAt: now, Expires: now.Add(time.Minute)}, 50*time.Millisecond)
+	s.Set("/api/personas", &Entry{Body: []byte("personas")}, time.Minute)
+	s.Delete("/api/personas")
+	s.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	s, err = OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	e, ok := s.Get("/api/spins")
+	if !ok || string(e.Body) != "spins" {
+		t.Fatalf("Get(/api/spins) = %v, %t; want restored entry", e, ok)
+	}
+	if !e.Expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("restored Expires = %s; want %s", e.Expires, now.Add(time.Minute))
+	}
+	if _, ok := s.Get("/api/shows"); ok {
+		t.Error("Get(/api/shows) found an entry whose TTL ran out while closed")
+	}
+	if _, ok := s.Get("/api/personas"); ok {
+		t.Error("Get(/api/personas) found a deleted entry")
+	}
+
+	// Only the live entry's file should be left.
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("directory has %d files; want 1", len(files))
+	}
+}
+
+// Checks that concurrent writes to one key leave the same entry on disk as in
+// memory, so that a restart doesn't bring back an older one.
+func TestDiskStoreConcurrentSets(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Set("/api/spins", &Entry{Body: []byte(strconv.Itoa(i))}, time.Minute)
+		}()
+	}
+	wg.Wait()
+	inMemory, _ := s.Get("/api/spins")
+	s.Close()
+
+	s, err = OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if onDisk, ok := s.Get("/api/spins"); !ok || string(onDisk.Body) != string(inMemory.Body) {
+		t.Errorf("restored body = %q; want %q, as in memory before the restart", onDisk.Body, inMemory.Body)
+	}
+}
+
+// Checks that a Cache backed by a DiskStore still evicts whole collections.
+func TestDiskStoreCollectionEviction(t *testing.T) {
+	s, err := OpenDiskStore(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Cache{
+		Store: s,
+		TTLs: NewTTLPolicy(TTLTable{
+			Collections: map[string]time.Duration{"spins": 50 * time.Millisecond},
+			Resource:    time.Minute,
+		}),
+	}
+	c.Init()
+
+	c.Set("/api/spins", &Entry{Body: []byte("page 1")})
+	c.Set("/api/spins/1", &Entry{Body: []byte("spin 1")})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && c.Len() > 0 {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after collection expired; want 0", c.Len())
+	}
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultHeaders lists the upstream response headers kept with each entry
+// when Cache.Headers is empty. A trailing "*" matches any header with that
+// prefix.
+var DefaultHeaders = []string{
+	"Content-Type",
+	"Content-Language",
+	"Content-Disposition",
+	"Link",
+	"X-Pagination-*",
+}
+
+// Entry is a cached upstream response together with the time it was stored
+// and the time it stops being fresh. Entries are kept past Expires for the
+// cache's grace window so they can still be served stale.
+type Entry struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	// Content coding Body is stored in, e.g. "gzip"; empty if none.
+	Encoding string `json:"encoding,omitempty"`
+	// Strong validator for the uncompressed body, quoted as sent in the ETag
+	// header.
+	ETag     string    `json:"etag"`
+	StoredAt time.Time `json:"stored_at"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Fresh reports whether the entry is still within its TTL at time now.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Age returns how long ago the entry was stored.
+func (e *Entry) Age(now time.Time) time.Duration {
+	return now.Sub(e.StoredAt)
+}
+
+// Identity returns the body without its content coding.
+func (e *Entry) Identity() ([]byte, error) {
+	return decompress(e.Encoding, e.Body)
+}
+
+// MaxAge returns how long the entry stays fresh from now on, or zero once it
+// has expired.
+func (e *Entry) MaxAge(now time.Time) time.Duration {
+	return max(e.Expires.Sub(now), 0)
+}
+
+// Staleness returns how long the entry has been expired, or zero if it is
+// still fresh.
+func (e *Entry) Staleness(now time.Time) time.Duration {
+	if e.Fresh(now) {
+		return 0
+	}
+	return now.Sub(e.Expires)
+}
+
+// filterHeaders returns the headers in h whose names match one of the
+// patterns in allowed, e.g. "Link" or "X-Pagination-*".
+func filterHeaders(h http.Header, allowed []string) http.Header {
+	out := make(http.Header)
+	for name, values := range h {
+		for _, pattern := range allowed {
+			pattern = http.CanonicalHeaderKey(pattern)
+			prefix, wildcard := strings.CutSuffix(pattern, "*")
+			if name == pattern || (wildcard && strings.HasPrefix(name, prefix)) {
+				out[name] = append([]string(nil), values...)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// makeETag returns a strong entity tag for body.
+func makeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
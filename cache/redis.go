@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout bounds each Redis operation, so a slow or unreachable
+	// Redis degrades to cache misses instead of hanging requests.
+	redisTimeout = 2 * time.Second
+	// redisSweepInterval is how often expired keys are looked for.
+	redisSweepInterval = time.Second
+)
+
+// popExpired atomically removes and returns every member of the sorted set
+// KEYS[1] with a score of at most ARGV[1].
+var popExpired = redis.NewScript(`
+local keys = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if #keys > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+end
+return keys
+`)
+
+// RedisStore is a Store kept in Redis, so that several proxy replicas share
+// one cache: an entry set or deleted by one replica (including a forced
+// refresh or a collection eviction) is immediately visible to the others.
+//
+// Redis expires entries on its own, but doesn't tell us when. To still evict
+// whole collections on expiry, every key is also added to a sorted set scored
+// by its expiry time, which each replica sweeps periodically. Removing a key
+// from that set is atomic, so exactly one replica handles each expiry.
+type RedisStore struct {
+	client   *redis.Client
+	prefix   string
+	onExpire atomic.Pointer[func(key string)]
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRedisStore creates a RedisStore using client, with every Redis key
+// starting with prefix (e.g. "spinitron-proxy:"). Replicas that should share
+// a cache must use the same prefix.
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	s := &RedisStore{
+		client: client,
+		prefix: prefix,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.sweepLoop()
+	return s
+}
+
+func (s *RedisStore) entryKey(key string) string { return s.prefix + "entry:" + key }
+func (s *RedisStore) indexKey() string           { return s.prefix + "expiry" }
+
+func (s *RedisStore) Get(key string) (*Entry, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.entryKey(key)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Error("cache.redis.get failed", "key", key, "error", err)
+		}
+		return nil, false
+	}
+
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		slog.Warn("cache.redis.corrupt", "key", key, "error", err)
+		return nil, false
+	}
+	return &e, true
+}
+
+func (s *RedisStore) Set(key string, e *Entry, ttl time.Duration) bool {
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("cache.redis.set failed", "key", key, "error", err)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	removeAt := time.Now().Add(ttl)
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, s.entryKey(key), data, ttl)
+		p.ZAdd(ctx, s.indexKey(), redis.Z{Score: float64(removeAt.UnixMilli()), Member: key})
+		return nil
+	})
+	if err != nil {
+		slog.Error("cache.redis.set failed", "key", key, "error", err)
+		return false
+	}
+	return true
+}
+
+func (s *RedisStore) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, s.entryKey(key))
+		p.ZRem(ctx, s.indexKey(), key)
+		return nil
+	})
+	if err != nil {
+		slog.Error("cache.redis.delete failed", "key", key, "error", err)
+	}
+}
+
+// Range calls fn for every entry that hasn't expired yet, in no particular
+// order.
+func (s *RedisStore) Range(fn func(key string, e *Entry) bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys, err := s.liveKeys(ctx)
+	if err != nil {
+		slog.Error("cache.redis.range failed", "error", err)
+		return
+	}
+
+	for _, key := range keys {
+		e, ok := s.Get(key)
+		if !ok {
+			continue
+		}
+		if !fn(key, e) {
+			return
+		}
+	}
+}
+
+func (s *RedisStore) Len() int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys, err := s.liveKeys(ctx)
+	if err != nil {
+		slog.Error("cache.redis.len failed", "error", err)
+		return 0
+	}
+	return len(keys)
+}
+
+// liveKeys returns every key in the index whose expiry is still ahead.
+func (s *RedisStore) liveKeys(ctx context.Context) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return s.client.ZRangeByScore(ctx, s.indexKey(), &redis.ZRangeBy{Min: "(" + now, Max: "+inf"}).Result()
+}
+
+func (s *RedisStore) OnExpire(fn func(key string)) {
+	s.onExpire.Store(&fn)
+}
+
+// Close stops the expiry sweeper and closes the Redis client.
+func (s *RedisStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.client.Close()
+}
+
+func (s *RedisStore) sweepLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(redisSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep claims every expired key in the index and reports it to the expiry
+// callback. Claiming is atomic, so keys claimed by another replica first are
+// never seen here.
+func (s *RedisStore) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	expired, err := popExpired.Run(ctx, s.client, []string{s.indexKey()}, time.Now().UnixMilli()).StringSlice()
+	if err != nil {
+		slog.Error("cache.redis.sweep failed", "error", err)
+		return
+	}
+
+	fn := s.onExpire.Load()
+	for _, key := range expired {
+		if fn != nil {
+			(*fn)(key)
+		}
+	}
+}
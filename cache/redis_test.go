@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newReplica returns a Cache backed by the Redis server at addr, as a proxy
+// replica would create it.
+func newReplica(t *testing.T, addr string, ttls TTLTable) *Cache {
+	t.Helper()
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: addr}), "test:")
+	c := &Cache{Store: store, TTLs: NewTTLPolicy(ttls)}
+	c.Init()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRedisStoreSharedAcrossReplicas(t *testing.T) {
+	srv := miniredis.RunT(t)
+	ttls := TTLTable{Default: time.Minute}
+	a := newReplica(t, srv.Addr(), ttls)
+	b := newReplica(t, srv.Addr(), ttls)
+
+	a.Set("/api/spins", &Entry{Body: []byte("v1")})
+	e, ok := b.Get("/api/spins")
+	if !ok || string(e.Body) != "v1" {
+		t.Fatalf("replica b Get(/api/spins) = %v, %t; want v1 set by replica a", e, ok)
+	}
+
+	// A forced refresh on one replica is what the other serves next.
+	b.Set("/api/spins", &Entry{Body: []byte("v2")})
+	if e, _ := a.Get("/api/spins"); e == nil || string(e.Body) != "v2" {
+		t.Errorf("replica a Get(/api/spins) = %v; want v2 set by replica b", e)
+	}
+
+	if a.Len() != 1 || b.Len() != 1 {
+		t.Errorf("Len() = %d, %d; want 1, 1", a.Len(), b.Len())
+	}
+
+	a.Store.Delete("/api/spins")
+	if _, ok := b.Get("/api/spins"); ok {
+		t.Error("replica b still has /api/spins after replica a deleted it")
+	}
+}
+
+// Checks that when a collection key expires, exactly one replica handles it
+// and the whole collection disappears for every replica.
+func TestRedisStoreCollectionExpiry(t *testing.T) {
+	srv := miniredis.RunT(t)
+	ttls := TTLTable{
+		Collections: map[string]time.Duration{"spins": 50 * time.Millisecond},
+		Resource:    time.Minute,
+	}
+	a := newReplica(t, srv.Addr(), ttls)
+	b := newReplica(t, srv.Addr(), ttls)
+
+	var expired atomic.Int32
+	for _, c := range []*Cache{a, b} {
+		c := c
+		c.Store.OnExpire(func(k string) {
+			expired.Add(1)
+			c.evictCollection("spins", "collection")
+		})
+	}
+
+	a.Set("/api/spins", &Entry{Body: []byte("page 1")})
+	a.Set("/api/spins/1", &Entry{Body: []byte("spin 1")})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := b.Get("/api/spins/1"); !ok {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, ok := b.Get("/api/spins/1"); ok {
+		t.Error("/api/spins/1 survived the expiry of its collection")
+	}
+	if n := expired.Load(); n != 1 {
+		t.Errorf("expiry handled %d times; want 1", n)
+	}
+}
+
+// Checks that an unreachable Redis degrades to cache misses.
+func TestRedisStoreUnavailable(t *testing.T) {
+	srv := miniredis.RunT(t)
+	c := newReplica(t, srv.Addr(), TTLTable{Default: time.Minute})
+	srv.Close()
+
+	if c.Set("/api/spins", &Entry{Body: []byte("v1")}) {
+		t.Error("Set() = true with Redis down; want false")
+	}
+	if _, ok := c.Get("/api/spins"); ok {
+		t.Error("Get() found an entry with Redis down")
+	}
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/atomicfile"
+)
+
+// SaveSnapshot writes every entry to the file at path, one JSON record per
+// line, so that LoadSnapshot can warm the cache up on the next start. It is
+// meant for the memory store; the disk and Redis stores outlive the process
+// on their own.
+func (c *Cache) SaveSnapshot(path string) (int, error) {
+	grace := c.grace()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	n := 0
+	var err error
+	c.Store.Range(func(k string, e *Entry) bool {
+		// Records use the same format as the disk store's files.
+		if err = enc.Encode(diskRecord{Key: k, Entry: e, RemoveAt: e.Expires.Add(grace)}); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cache: snapshot: %w", err)
+	}
+
+	if err := atomicfile.Write(path, buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("cache: snapshot: %w", err)
+	}
+	slog.Info("cache.snapshot.saved", "count", n, "path", path)
+	return n, nil
+}
+
+// LoadSnapshot restores the entries saved by SaveSnapshot at path with their
+// remaining TTL, skipping those that have expired since. The file is removed
+// afterwards, so that a later crash can't bring back older data. A missing
+// file is not an error.
+func (c *Cache) LoadSnapshot(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cache: snapshot: %w", err)
+	}
+
+	now := time.Now()
+	n := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var rec diskRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Entry == nil {
+			slog.Warn("cache.snapshot.corrupt", "path", path)
+			continue
+		}
+		if remaining := rec.RemoveAt.Sub(now); remaining > 0 && c.Store.Set(rec.Key, rec.Entry, remaining) {
+			n++
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		slog.Warn("cache.snapshot.remove failed", "path", path, "error", err)
+	}
+	slog.Info("cache.snapshot.loaded", "count", n, "path", path)
+	return n, nil
+}
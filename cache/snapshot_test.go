@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	ttls := TTLTable{Default: time.Minute}
+
+	a := &Cache{TTLs: NewTTLPolicy(ttls)}
+	a.Init()
+	a.Set("/api/spins", &Entry{Body: []byte("page 1")})
+	a.Set("/api/shows/1", &Entry{Body: []byte("show 1")})
+
+	if n, err := a.SaveSnapshot(path); err != nil || n != 2 {
+		t.Fatalf("SaveSnapshot() = %d, %v; want 2, nil", n, err)
+	}
+
+	b := &Cache{TTLs: NewTTLPolicy(ttls)}
+	b.Init()
+	if n, err := b.LoadSnapshot(path); err != nil || n != 2 {
+		t.Fatalf("LoadSnapshot() = %d, %v; want 2, nil", n, err)
+	}
+
+	e, ok := b.Get("/api/shows/1")
+	if !ok || string(e.Body) != "show 1" || !e.Fresh(time.Now()) {
+		t.Errorf("restored /api/shows/1 = %+v, %t; want the fresh entry", e, ok)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("snapshot file still exists after loading it")
+	}
+
+	// A missing snapshot just means a cold start.
+	if n, err := b.LoadSnapshot(path); err != nil || n != 0 {
+		t.Errorf("LoadSnapshot() of a missing file = %d, %v; want 0, nil", n, err)
+	}
+}
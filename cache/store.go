@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Yiling-J/theine-go"
+)
+
+// Store is the storage backend behind a Cache. Implementations must be safe
+// for concurrent use.
+type Store interface {
+	// Get returns the entry stored under key, if any.
+	Get(key string) (*Entry, bool)
+	// Set stores an entry under key and removes it once ttl has passed.
+	// Returns true if the entry was stored.
+	Set(key string, e *Entry, ttl time.Duration) bool
+	// Delete removes key from the store.
+	Delete(key string)
+	// Range calls fn for every stored entry until fn returns false.
+	Range(fn func(key string, e *Entry) bool)
+	// Len returns the number of stored entries.
+	Len() int
+	// OnExpire registers fn to be called with each key whose ttl runs out.
+	OnExpire(fn func(key string))
+	// Close releases the store's resources.
+	Close() error
+}
+
+// MemoryStore is an in-memory Store backed by a theine cache. Entries are lost
+// when the process exits.
+type MemoryStore struct {
+	tcache   *theine.Cache[string, *Entry] // Underlying cache from theine-go library.
+	onExpire atomic.Pointer[func(key string)]
+	// Called for every entry theine expires or evicts on its own. Used by
+	// DiskStore to delete the entry's file.
+	onDrop func(key string, e *Entry)
+}
+
+// NewMemoryStore creates a MemoryStore holding at most size entries.
+func NewMemoryStore(size int) *MemoryStore {
+	s := &MemoryStore{}
+
+	// Build a theine cache with our maximum size. The RemovalListener is
+	// called whenever an item is removed from the cache, with a RemoveReason
+	// telling us why.
+	tcache, err := theine.NewBuilder[string, *Entry](int64(size)).RemovalListener(func(k string, v *Entry, r theine.RemoveReason) {
+		if r == theine.REMOVED {
+			// Explicit deletes are handled by whoever called Delete.
+			return
+		}
+		if s.onDrop != nil {
+			s.onDrop(k, v)
+		}
+		if fn := s.onExpire.Load(); fn != nil && r == theine.EXPIRED {
+			(*fn)(k)
+		}
+	}).Build()
+
+	if err != nil {
+		// If building the cache fails, panic to crash early. This only
+		// happens for an invalid size.
+		panic(err)
+	}
+
+	s.tcache = tcache
+	return s
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	return s.tcache.Get(key)
+}
+
+func (s *MemoryStore) Set(key string, e *Entry, ttl time.Duration) bool {
+	// The '1' argument is for cost (weight) of the entry, used for cache
+	// eviction strategies. We don't use it here, so it's set to 1 for all
+	// entries.
+	return s.tcache.SetWithTTL(key, e, 1, ttl)
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.tcache.Delete(key)
+}
+
+func (s *MemoryStore) Range(fn func(key string, e *Entry) bool) {
+	s.tcache.Range(fn)
+}
+
+func (s *MemoryStore) Len() int {
+	return s.tcache.Len()
+}
+
+func (s *MemoryStore) OnExpire(fn func(key string)) {
+	s.onExpire.Store(&fn)
+}
+
+func (s *MemoryStore) Close() error {
+	s.tcache.Close()
+	return nil
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
+)
+
+// TTLTable is a plain-data view of a TTLPolicy. A TTL of zero means "do not
+// cache".
+type TTLTable struct {
+	// Fallback for anything not matched below.
+	Default time.Duration
+	// Fallback for individual resources, e.g. /api/spins/1.
+	Resource time.Duration
+	// TTL per collection name, e.g. "spins" for /api/spins?page=2.
+	Collections map[string]time.Duration
+	// TTL for resources of a given collection, e.g. "spins" for
+	// /api/spins/1. Overrides Resource.
+	Resources map[string]time.Duration
+}
+
+// TTLPolicy decides how long each cache key lives. It is safe for concurrent
+// use and may be changed while the proxy is running; changes apply to
+// entries stored afterwards.
+type TTLPolicy struct {
+	mu    sync.RWMutex
+	table TTLTable
+}
+
+// NewTTLPolicy creates a policy from the given table.
+func NewTTLPolicy(t TTLTable) *TTLPolicy {
+	p := &TTLPolicy{}
+	p.SetTable(t)
+	return p
+}
+
+// TTL returns the time-to-live for a cache key. Resource keys are looked up
+// by their collection in Resources, then fall back to Resource (or Default
+// when Resource is zero); collection keys are looked up in Collections.
+// Anything else gets Default.
+func (p *TTLPolicy) TTL(key string) time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	name := api.GetCollectionName(key)
+
+	if api.IsResourcePath(key) {
+		if ttl, ok := p.table.Resources[name]; ok {
+			return ttl
+		}
+		if p.table.Resource > 0 {
+			return p.table.Resource
+		}
+		return p.table.Default
+	}
+
+	if ttl, ok := p.table.Collections[name]; ok {
+		return ttl
+	}
+	return p.table.Default
+}
+
+// Table returns a copy of the current TTL table.
+func (p *TTLPolicy) Table() TTLTable {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return copyTable(p.table)
+}
+
+// SetTable replaces the whole TTL table.
+func (p *TTLPolicy) SetTable(t TTLTable) {
+	t = copyTable(t)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table = t
+}
+
+// SetDefault sets the fallback TTL.
+func (p *TTLPolicy) SetDefault(ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table.Default = ttl
+}
+
+// SetResourceDefault sets the fallback TTL for individual resources.
+func (p *TTLPolicy) SetResourceDefault(ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table.Resource = ttl
+}
+
+// SetCollection sets the TTL for a collection.
+func (p *TTLPolicy) SetCollection(name string, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table.Collections[name] = ttl
+}
+
+// DeleteCollection removes a collection's TTL so it falls back to Default.
+func (p *TTLPolicy) DeleteCollection(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.table.Collections, name)
+}
+
+// SetResource sets the TTL for resources in a collection.
+func (p *TTLPolicy) SetResource(name string, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table.Resources[name] = ttl
+}
+
+// DeleteResource removes a collection's resource TTL so it falls back to
+// Resource.
+func (p *TTLPolicy) DeleteResource(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.table.Resources, name)
+}
+
+// copyTable deep-copies a table so callers can't mutate the policy's maps.
+func copyTable(t TTLTable) TTLTable {
+	out := t
+	out.Collections = make(map[string]time.Duration, len(t.Collections))
+	for k, v := range t.Collections {
+		out.Collections[k] = v
+	}
+	out.Resources = make(map[string]time.Duration, len(t.Resources))
+	for k, v := range t.Resources {
+		out.Resources[k] = v
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLPolicyFallbacks(t *testing.T) {
+	p := NewTTLPolicy(TTLTable{
+		Default:     time.Minute,
+		Resource:    3 * time.Minute,
+		Collections: map[string]time.Duration{"spins": 30 * time.Second},
+		Resources:   map[string]time.Duration{"personas": 10 * time.Minute},
+	})
+
+	tests := map[string]time.Duration{
+		"/api/spins":            30 * time.Second,
+		"/api/spins?page=2":     30 * time.Second,
+		"/api/spins/1":          3 * time.Minute,
+		"/api/personas/1":       10 * time.Minute,
+		"/api/metadata":         time.Minute,
+		"/images/Persona/1.jpg": 3 * time.Minute,
+	}
+
+	for key, want := range tests {
+		if got := p.TTL(key); got != want {
+			t.Errorf("TTL(%q) = %s; want %s", key, got, want)
+		}
+	}
+}
+
+// Checks that a zero resource TTL falls back to the default.
+func TestTTLPolicyZeroResource(t *testing.T) {
+	p := NewTTLPolicy(TTLTable{Default: time.Minute})
+
+	if got := p.TTL("/api/shows/1"); got != time.Minute {
+		t.Errorf("TTL(/api/shows/1) = %s; want 1m", got)
+	}
+}
+
+func TestTTLPolicyUpdates(t *testing.T) {
+	p := NewTTLPolicy(TTLTable{})
+
+	p.SetCollection("spins", 10*time.Second)
+	if got := p.TTL("/api/spins"); got != 10*time.Second {
+		t.Errorf("TTL after SetCollection = %s; want 10s", got)
+	}
+
+	p.SetDefault(time.Minute)
+	p.DeleteCollection("spins")
+	if got := p.TTL("/api/spins"); got != time.Minute {
+		t.Errorf("TTL after DeleteCollection = %s; want default 1m", got)
+	}
+
+	// Mutating a returned table must not change the policy.
+	table := p.Table()
+	table.Collections["spins"] = time.Hour
+	if got := p.TTL("/api/spins"); got != time.Minute {
+		t.Errorf("TTL after mutating Table() copy = %s; want 1m", got)
+	}
+}
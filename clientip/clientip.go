@@ -0,0 +1,190 @@
+// Package clientip works out the address of the client behind a request.
+//
+// Behind a reverse proxy or CDN (Caddy, Cloudflare, ...), r.RemoteAddr is the
+// proxy's address, and the real client is only named in headers the proxies
+// add. Those headers can be sent by anyone, so they are only believed when
+// the request comes from a trusted proxy, and only as far back as the chain
+// of trusted proxies goes.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Set is a list of address ranges, such as the trusted proxies.
+type Set []netip.Prefix
+
+// ParseSet parses CIDR ranges ("10.0.0.0/8") and single addresses
+// ("192.0.2.1").
+func ParseSet(cidrs []string) (Set, error) {
+	var set Set
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("clientip: invalid address %q", s)
+			}
+			set = append(set, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("clientip: invalid range %q", s)
+		}
+		set = append(set, prefix.Masked())
+	}
+	return set, nil
+}
+
+// Contains reports whether addr is in one of the ranges.
+func (s Set) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsIP is like Contains for an address in text form, as returned by
+// FromRequest. Anything that isn't an IP address is in no set.
+func (s Set) ContainsIP(ip string) bool {
+	addr, ok := parseAddr(ip)
+	return ok && s.Contains(addr)
+}
+
+// DefaultHeader is the forwarding header read when none is configured. It is
+// the one Caddy, Cloudflare and most other proxies append to.
+const DefaultHeader = "X-Forwarded-For"
+
+// Resolver finds client addresses given the set of trusted proxies.
+type Resolver struct {
+	trusted Set
+	header  string
+}
+
+// New returns a Resolver trusting the proxies in cidrs, given as CIDR ranges
+// or single addresses (see ParseSet), to name the client in header (by
+// default DefaultHeader). Only that header is read: the proxies pass any
+// other forwarding header sent by the client through unchanged, so it can't
+// be believed. With no trusted proxies, headers are ignored and the client is
+// always r.RemoteAddr.
+func New(cidrs []string, header string) (*Resolver, error) {
+	trusted, err := ParseSet(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	header = strings.TrimSpace(header)
+	if header == "" {
+		header = DefaultHeader
+	}
+	if strings.ContainsAny(header, " \t:,;") {
+		return nil, fmt.Errorf("clientip: invalid header name %q", header)
+	}
+	return &Resolver{trusted: trusted, header: http.CanonicalHeaderKey(header)}, nil
+}
+
+// Resolve returns the client address of r. If r comes from a trusted proxy,
+// the configured header is consulted: a Forwarded (RFC 7239) header's for=
+// parameters, or for any other header (X-Forwarded-For, X-Real-IP,
+// CF-Connecting-IP, ...) a comma-separated list of addresses. The hops are
+// walked from the nearest one back, and the first hop that isn't a trusted
+// proxy is the client.
+func (res *Resolver) Resolve(r *http.Request) string {
+	remote, ok := parseAddr(r.RemoteAddr)
+	if !ok {
+		return hostOnly(r.RemoteAddr)
+	}
+	if !res.trusted.Contains(remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	if res.header == "Forwarded" {
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		for _, v := range r.Header.Values(res.header) {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(hops[i])
+		if !ok {
+			// "unknown", an obfuscated identifier or garbage: we can't see
+			// past this hop, so the last one we could is the client.
+			break
+		}
+		client = addr
+		if !res.trusted.Contains(addr) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values, e.g.
+// `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`, in order.
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					out = append(out, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// parseAddr parses an IP address optionally followed by a port, with IPv6
+// addresses optionally in brackets.
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr, true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// hostOnly strips the port from addr, if it has one.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+type contextKey struct{}
+
+// Middleware resolves each request's client address once and stores it in
+// the request's context, for FromRequest.
+func Middleware(res *Resolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKey{}, res.Resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromRequest returns the client address of r as resolved by Middleware, or
+// the host part of r.RemoteAddr if Middleware wasn't used.
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(contextKey{}).(string); ok {
+		return ip
+	}
+	return hostOnly(r.RemoteAddr)
+}
@@ -0,0 +1,159 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewRejectsInvalidProxies(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "not an ip", ""} {
+		if _, err := New([]string{s}, ""); err == nil {
+			t.Errorf("New(%q) returned nil error", s)
+		}
+	}
+	if _, err := New(nil, "X-Forwarded-For: x"); err == nil {
+		t.Error("New() with an invalid header name returned nil error")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}
+
+	tests := []struct {
+		name    string
+		header  string // "" for the default, X-Forwarded-For
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:   "direct client",
+			remote: "198.51.100.7:5000",
+			want:   "198.51.100.7",
+		},
+		{
+			name:    "untrusted peer can't spoof",
+			remote:  "198.51.100.7:5000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "x-forwarded-for",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "x-forwarded-for through several trusted proxies",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9, 192.0.2.1, 10.9.9.9"},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "spoofed leftmost x-forwarded-for hop is ignored",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.9"},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "x-real-ip",
+			header:  "X-Real-IP",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Real-IP": "203.0.113.9"},
+			want:    "203.0.113.9",
+		},
+		{
+			name:   "spoofed forwarded header is ignored",
+			remote: "10.0.0.5:5000",
+			headers: map[string]string{
+				"Forwarded":       "for=192.0.2.99",
+				"X-Forwarded-For": "198.51.100.7",
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:    "spoofed x-real-ip is ignored",
+			remote:  "10.0.0.5:5000",
+			headers: map[string]string{"X-Real-IP": "192.0.2.99"},
+			want:    "10.0.0.5",
+		},
+		{
+			name:   "forwarded",
+			header: "forwarded",
+			remote: "10.1.2.3:5000",
+			headers: map[string]string{
+				"Forwarded":       `for=203.0.113.9;proto=https, for="[2001:db8::17]:4711"`,
+				"X-Forwarded-For": "198.51.100.7",
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:    "forwarded ipv6 client",
+			header:  "Forwarded",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": `for="[2001:db9::17]:4711"`},
+			want:    "2001:db9::17",
+		},
+		{
+			name:    "unknown hop stops the walk",
+			header:  "Forwarded",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": "for=203.0.113.9, for=unknown, for=10.2.2.2"},
+			want:    "10.2.2.2",
+		},
+		{
+			name:   "trusted proxy without headers",
+			remote: "10.1.2.3:5000",
+			want:   "10.1.2.3",
+		},
+		{
+			name:    "ipv4-mapped ipv6 peer",
+			remote:  "[::ffff:10.1.2.3]:5000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			want:    "203.0.113.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := New(trusted, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/spins", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := res.Resolve(r); got != tt.want {
+				t.Errorf("Resolve() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	res, err := New([]string{"10.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	h := Middleware(res, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromRequest(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "203.0.113.9" {
+		t.Errorf("FromRequest() = %q; want 203.0.113.9", got)
+	}
+
+	// Without the middleware, the peer address is used as is.
+	if got := FromRequest(r); got != "10.1.2.3" {
+		t.Errorf("FromRequest() without middleware = %q; want 10.1.2.3", got)
+	}
+}
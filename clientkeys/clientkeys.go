@@ -0,0 +1,367 @@
+// Package clientkeys issues and checks the API keys that identify the
+// proxy's own clients (the station website, its mobile app, monitoring...),
+// as opposed to the proxy's key for Spinitron.
+//
+// Each key can be limited to some collections and given its own rate limit,
+// counts its usage, and can be revoked without affecting the others. Keys are
+// kept in a JSON file. Only a hash of each secret is stored, so the secret is
+// shown once, when the key is created.
+package clientkeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/atomicfile"
+	"github.com/wbor-fm/spinitron-proxy/config"
+	"github.com/wbor-fm/spinitron-proxy/ratelimiter"
+)
+
+// usageSaveInterval is how often usage counters are written to the file.
+// Creating and revoking keys is saved immediately.
+const usageSaveInterval = time.Minute
+
+// ErrNotFound is returned for operations on a key that doesn't exist.
+var ErrNotFound = errors.New("clientkeys: no such key")
+
+// Key is a client's API key, without its secret.
+type Key struct {
+	// Public identifier, used by the admin API and in logs.
+	ID string `json:"id"`
+	// Who the key is for, e.g. "mobile app".
+	Name string `json:"name"`
+	// SHA-256 of the secret, in hex.
+	SecretHash string `json:"secret_hash"`
+	// Collections the key may access ("spins", "shows", ..., "images").
+	// /spin-events counts as "spins". Empty allows everything.
+	Collections []string `json:"collections,omitempty"`
+	// Rate limit tier, matched by rate limit policies listing it.
+	Tier string `json:"tier,omitempty"`
+	// The key's own rate limit, replacing the policies for its requests.
+	// Nil leaves it to the policies.
+	RateLimit *Limit `json:"rate_limit,omitempty"`
+
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+	Usage   Usage      `json:"usage"`
+}
+
+// Limit is a per-key rate limit.
+type Limit struct {
+	MaxRequests int             `json:"max_requests"`
+	Window      config.Duration `json:"window"`
+	// Which of the key's requests share a bucket: "global" (the default)
+	// limits the key as a whole, "ip" each address using it, and so on (see
+	// ratelimiter.GroupBy).
+	GroupBy ratelimiter.GroupBy `json:"group_by,omitempty"`
+}
+
+// Usage counts a key's requests.
+type Usage struct {
+	Requests    int64            `json:"requests"`
+	Collections map[string]int64 `json:"collections,omitempty"`
+	LastUsed    *time.Time       `json:"last_used,omitempty"`
+}
+
+// Active reports whether the key is usable, i.e. hasn't been revoked.
+func (k *Key) Active() bool {
+	return k.Revoked == nil
+}
+
+// Allows reports whether the key may access collection.
+func (k *Key) Allows(collection string) bool {
+	return len(k.Collections) == 0 || slices.Contains(k.Collections, collection)
+}
+
+// clone returns a deep copy of k, safe to hand out while the store keeps
+// updating k.
+func (k *Key) clone() Key {
+	out := *k
+	out.Collections = slices.Clone(k.Collections)
+	if k.RateLimit != nil {
+		limit := *k.RateLimit
+		out.RateLimit = &limit
+	}
+	if k.Usage.Collections != nil {
+		out.Usage.Collections = make(map[string]int64, len(k.Usage.Collections))
+		for c, n := range k.Usage.Collections {
+			out.Usage.Collections[c] = n
+		}
+	}
+	return out
+}
+
+// file is the layout of the keys file.
+type file struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Store holds the keys, backed by a file.
+type Store struct {
+	// NewLimiter creates the limiter enforcing a key's RateLimit, named
+	// after the key. Nil creates a ratelimiter.RateLimiter, local to this
+	// process.
+	NewLimiter func(name string, limit Limit) ratelimiter.Limiter
+
+	path string
+
+	mu       sync.Mutex // to synchronize access to everything below
+	keys     map[string]*Key
+	bySecret map[string]*Key // by SecretHash
+	policies map[string]*ratelimiter.Policy
+	dirty    bool // usage has changed since the file was written
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open loads the keys saved at path, if any, and starts saving usage
+// counters there periodically. The file is created when the first key is.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		keys:     make(map[string]*Key),
+		bySecret: make(map[string]*Key),
+		policies: make(map[string]*ratelimiter.Policy),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("clientkeys: %w", err)
+	default:
+		var f file
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("clientkeys: %s: %w", path, err)
+		}
+		for _, k := range f.Keys {
+			s.keys[k.ID] = k
+			s.bySecret[k.SecretHash] = k
+		}
+	}
+
+	go s.saveLoop()
+	return s, nil
+}
+
+// hashSecret returns the hash stored for secret.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms.
+	}
+	return hex.EncodeToString(b)
+}
+
+// Create issues a new key with the name, collections, tier and rate limit of
+// k, and returns it along with its secret.
+func (s *Store) Create(k Key) (Key, string, error) {
+	secret := "spk_" + randomHex(24)
+	key := &Key{
+		ID:          "key_" + randomHex(6),
+		Name:        k.Name,
+		SecretHash:  hashSecret(secret),
+		Collections: slices.Clone(k.Collections),
+		Tier:        k.Tier,
+		RateLimit:   k.RateLimit,
+		Created:     time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = key
+	s.bySecret[key.SecretHash] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, key.ID)
+		delete(s.bySecret, key.SecretHash)
+		return Key{}, "", err
+	}
+	return key.clone(), secret, nil
+}
+
+// Revoke disables the key with the given ID for good. Revoked keys are kept,
+// with their usage, until deleted from the file by hand.
+func (s *Store) Revoke(id string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	if k.Active() {
+		now := time.Now().UTC()
+		k.Revoked = &now
+		delete(s.policies, id)
+		if err := s.save(); err != nil {
+			k.Revoked = nil
+			return Key{}, err
+		}
+	}
+	return k.clone(), nil
+}
+
+// Get returns the key with the given ID.
+func (s *Store) Get(id string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, false
+	}
+	return k.clone(), true
+}
+
+// List returns every key, oldest first.
+func (s *Store) List() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		out = append(out, k.clone())
+	}
+	slices.SortFunc(out, func(a, b Key) int { return a.Created.Compare(b.Created) })
+	return out
+}
+
+// lookup returns the key whose secret is secret, revoked or not.
+func (s *Store) lookup(secret string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.bySecret[hashSecret(secret)]
+	if !ok {
+		return Key{}, false
+	}
+	return k.clone(), true
+}
+
+// recordUse counts a request made with the key with the given ID.
+func (s *Store) recordUse(id string, collections ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	k.Usage.Requests++
+	k.Usage.LastUsed = &now
+	if k.Usage.Collections == nil {
+		k.Usage.Collections = make(map[string]int64)
+	}
+	for _, c := range collections {
+		k.Usage.Collections[c]++
+	}
+	s.dirty = true
+}
+
+// policy returns the rate limit policy for the key with the given ID, or nil
+// if it has no rate limit of its own. Policies are created on first use and
+// kept, with their buckets, until the key is revoked.
+func (s *Store) policy(id string) *ratelimiter.Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.policies[id]; ok {
+		return p
+	}
+	k, ok := s.keys[id]
+	if !ok || k.RateLimit == nil {
+		return nil
+	}
+
+	limit := *k.RateLimit
+	if limit.GroupBy == "" {
+		limit.GroupBy = ratelimiter.GroupGlobal
+	}
+	name := "key:" + k.ID
+	var limiter ratelimiter.Limiter
+	if s.NewLimiter != nil {
+		limiter = s.NewLimiter(name, limit)
+	} else {
+		limiter = ratelimiter.NewRateLimiter(limit.MaxRequests, limit.Window.Duration)
+	}
+	p := &ratelimiter.Policy{Name: name, GroupBy: limit.GroupBy, Limiter: limiter}
+	s.policies[id] = p
+	return p
+}
+
+// save writes every key to the file. It must be called with mu held.
+func (s *Store) save() error {
+	f := file{Keys: make([]*Key, 0, len(s.keys))}
+	for _, k := range s.keys {
+		f.Keys = append(f.Keys, k)
+	}
+	slices.SortFunc(f.Keys, func(a, b *Key) int { return a.Created.Compare(b.Created) })
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("clientkeys: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *Store) saveLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.saveUsage()
+		}
+	}
+}
+
+// saveUsage writes the file if usage counters have changed.
+func (s *Store) saveUsage() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		slog.Error("clientkeys.save failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// Close stops the periodic saving and saves the latest usage counters.
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.saveUsage()
+}
@@ -0,0 +1,149 @@
+package clientkeys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/config"
+	"github.com/wbor-fm/spinitron-proxy/ratelimiter"
+)
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStorePersistsKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s := openTestStore(t, path)
+
+	app, secret, err := s.Create(Key{Name: "mobile app", Collections: []string{"spins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	widget, _, err := s.Create(Key{Name: "widget"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Revoke(widget.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.recordUse(app.ID, "spins")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path)
+	defer s.Close()
+
+	k, ok := s.lookup(secret)
+	if !ok || k.ID != app.ID || !k.Active() || k.Usage.Requests != 1 {
+		t.Errorf("lookup after reopening = %+v, %t; want active %s with 1 request", k, ok, app.ID)
+	}
+	if k, _ := s.Get(widget.ID); k.Active() {
+		t.Error("revoked key is active after reopening")
+	}
+	if _, ok := s.lookup("spk_wrong"); ok {
+		t.Error("lookup of an unknown secret succeeded")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "keys.json"))
+	defer s.Close()
+
+	_, spinsOnly, _ := s.Create(Key{Name: "spins only", Collections: []string{"spins"}})
+	revoked, revokedSecret, _ := s.Create(Key{Name: "revoked"})
+	s.Revoke(revoked.ID)
+
+	var seen *http.Request
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r })
+
+	tests := []struct {
+		name     string
+		required bool
+		target   string
+		header   string
+		want     int
+	}{
+		{"no key, optional", false, "/api/shows", "", http.StatusOK},
+		{"no key, required", true, "/api/shows", "", http.StatusUnauthorized},
+		{"unknown key, optional", false, "/api/shows", "spk_nope", http.StatusOK},
+		{"unknown key, required", true, "/api/shows", "spk_nope", http.StatusUnauthorized},
+		{"revoked key", false, "/api/spins", revokedSecret, http.StatusUnauthorized},
+		{"allowed collection", true, "/api/spins/1", spinsOnly, http.StatusOK},
+		{"spin events count as spins", true, "/spin-events", spinsOnly, http.StatusOK},
+		{"events of allowed types", true, "/events?types=spin", spinsOnly, http.StatusOK},
+		{"events of every type", true, "/events", spinsOnly, http.StatusForbidden},
+		{"spin events of other types", true, "/spin-events?types=spin,show", spinsOnly, http.StatusForbidden},
+		{"other collection", true, "/api/shows", spinsOnly, http.StatusForbidden},
+		{"query parameter", true, "/api/spins?api_key=" + spinsOnly + "&page=2", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(Header, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			s.Middleware(tt.required, next).ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status %d; want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	// The key was moved out of the URL, so it doesn't reach the cache key
+	// or Spinitron.
+	if seen.URL.RawQuery != "page=2" || seen.Header.Get(Header) != spinsOnly {
+		t.Errorf("query %q, header %q after the middleware; want page=2 and the key in the header",
+			seen.URL.RawQuery, seen.Header.Get(Header))
+	}
+	if k, ok := FromRequest(seen); !ok || k.Name != "spins only" {
+		t.Errorf("FromRequest() = %v, %t; want the spins only key", k, ok)
+	}
+}
+
+func TestKeyRateLimit(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "keys.json"))
+	defer s.Close()
+
+	_, limited, _ := s.Create(Key{Name: "limited", RateLimit: &Limit{MaxRequests: 2, Window: config.Duration{Duration: time.Minute}}})
+	_, unlimited, _ := s.Create(Key{Name: "unlimited"})
+
+	ps := &ratelimiter.Policies{
+		Default: &ratelimiter.Policy{Name: "default", Limiter: ratelimiter.NewRateLimiter(100, time.Minute)},
+		Client:  s.Policy,
+	}
+	h := s.Middleware(true, ps.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// codes returns the status codes of n requests made with secret from
+	// different addresses.
+	codes := func(secret string, n int) []int {
+		out := make([]int, n)
+		for i := range out {
+			r := httptest.NewRequest(http.MethodGet, "/api/spins", nil)
+			r.RemoteAddr = "192.0.2." + string(rune('1'+i)) + ":1234"
+			r.Header.Set(Header, secret)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			out[i] = rec.Code
+		}
+		return out
+	}
+
+	// By default a key's limit covers all of its users together.
+	if got := codes(limited, 3); got[2] != http.StatusTooManyRequests {
+		t.Errorf("limited key: status codes = %v; want the third to be 429", got)
+	}
+	if got := codes(unlimited, 3); got[2] != http.StatusOK {
+		t.Errorf("key without a limit of its own: status codes = %v; want all 200", got)
+	}
+}
@@ -0,0 +1,158 @@
+package clientkeys
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/ratelimiter"
+	"github.com/wbor-fm/spinitron-proxy/sse"
+)
+
+const (
+	// Header is the request header holding a client's key. It is the same
+	// header that rate limit tiers are read from.
+	Header = ratelimiter.APIKeyHeader
+	// QueryParam is the query parameter holding a client's key, for clients
+	// such as EventSource that can't set headers.
+	QueryParam = "api_key"
+)
+
+type contextKey struct{}
+
+// Collection returns the collection a request path belongs to, as listed in
+// Key.Collections: the collection name for /api/ paths, "images" for images
+// and "spins" for /spin-events.
+func Collection(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/"):
+		return api.GetCollectionName(path)
+	case strings.HasPrefix(path, "/images/"):
+		return "images"
+	case path == "/spin-events":
+		return "spins"
+	}
+	return ""
+}
+
+// Collections returns the collections a request reads: that of its path (see
+// Collection), or for event streams, those whose changes the event types it
+// subscribes to report (e.g. "shows" for ?types=show). Without types,
+// /spin-events reads spins and /events every collection that has events.
+func Collections(r *http.Request) []string {
+	path := r.URL.Path
+	if path != "/events" && path != "/spin-events" {
+		return []string{Collection(path)}
+	}
+
+	var collections []string
+	switch types := sse.Types(r); {
+	case types == nil && path == "/spin-events":
+		collections = []string{"spins"}
+	case types == nil:
+		for _, c := range api.EventCollections {
+			collections = append(collections, c)
+		}
+		slices.Sort(collections)
+	default:
+		for _, t := range types {
+			// Unknown types are refused by the stream itself.
+			if c, ok := api.EventCollections[t]; ok {
+				collections = append(collections, c)
+			}
+		}
+	}
+	return collections
+}
+
+// Middleware checks the key sent with each request, in Header or QueryParam.
+// Requests with a revoked key, or a key for a collection it doesn't allow,
+// are rejected. Requests without a key, or with one that isn't in the store,
+// are rejected if required is true and otherwise passed on anonymously, so
+// that keys can be rolled out before they are enforced.
+//
+// A key given in QueryParam is moved to Header, so that the URL (and with it
+// the cache key) is the same however the key was sent. Accepted keys are
+// counted and available to next through FromRequest.
+func (s *Store) Middleware(required bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(Header)
+		if q := r.URL.Query(); q.Has(QueryParam) {
+			if secret == "" {
+				secret = q.Get(QueryParam)
+			}
+			q.Del(QueryParam)
+
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = q.Encode()
+			r.RequestURI = r.URL.RequestURI()
+			r.Header.Set(Header, secret)
+		}
+
+		var (
+			k     Key
+			found bool
+		)
+		if secret != "" {
+			k, found = s.lookup(secret)
+		}
+
+		switch {
+		case !found && !required:
+			next.ServeHTTP(w, r)
+			return
+		case !found:
+			s.reject(w, r, http.StatusUnauthorized, "a valid API key is required", "")
+			return
+		case !k.Active():
+			s.reject(w, r, http.StatusUnauthorized, "API key has been revoked", k.ID)
+			return
+		}
+
+		collections := Collections(r)
+		for _, c := range collections {
+			if !k.Allows(c) {
+				s.reject(w, r, http.StatusForbidden, "API key does not allow "+c, k.ID)
+				return
+			}
+		}
+
+		s.recordUse(k.ID, collections...)
+		ctx := context.WithValue(r.Context(), contextKey{}, &k)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// reject logs a refused request and writes a JSON error.
+func (s *Store) reject(w http.ResponseWriter, r *http.Request, status int, msg, id string) {
+	slog.WarnContext(r.Context(), "clientkeys.rejected", "status", status, "key_id", id,
+		"path", r.URL.Path, "client_ip", clientip.FromRequest(r))
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `ApiKey header="`+Header+`"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// FromRequest returns the key accepted by Middleware for r, if any.
+func FromRequest(r *http.Request) (*Key, bool) {
+	k, ok := r.Context().Value(contextKey{}).(*Key)
+	return k, ok
+}
+
+// Policy returns the rate limit policy of the key r was made with, or nil if
+// there is none or the key has no rate limit of its own. It is meant for
+// ratelimiter.Policies.Client.
+func (s *Store) Policy(r *http.Request) *ratelimiter.Policy {
+	k, ok := FromRequest(r)
+	if !ok {
+		return nil
+	}
+	return s.policy(k.ID)
+}
@@ -0,0 +1,717 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+)
+
+// Config is the complete, typed configuration for the proxy. Values are
+// resolved in order of increasing precedence: built-in defaults, the YAML
+// config file, environment variables, and finally command-line flags.
+type Config struct {
+	// Address the HTTP server listens on, e.g. ":8080".
+	Listen string `yaml:"listen"`
+	// Password required by /trigger/spins. Empty disables the check.
+	TriggerPassword string `yaml:"trigger_password"`
+	// Reverse proxies (CIDR ranges or single addresses) whose ClientIPHeader
+	// is believed when working out the client's IP address. Empty means
+	// clients connect directly.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// The one header the trusted proxies set to name the client, e.g.
+	// "X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP" or "Forwarded".
+	// Other forwarding headers are ignored, since the proxies pass them on
+	// from the client unchanged.
+	ClientIPHeader string `yaml:"client_ip_header"`
+
+	Upstream   UpstreamConfig   `yaml:"upstream"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Cache      CacheConfig      `yaml:"cache"`
+	SSE        SSEConfig        `yaml:"sse"`
+	Admin      AdminConfig      `yaml:"admin"`
+	ClientKeys ClientKeysConfig `yaml:"client_keys"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Log        LogConfig        `yaml:"log"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Shutdown   ShutdownConfig   `yaml:"shutdown"`
+}
+
+// UpstreamConfig describes the Spinitron API we proxy to.
+type UpstreamConfig struct {
+	// Base URL of the Spinitron API.
+	URL string `yaml:"url"`
+	// Spinitron API key, injected as a bearer token on every request.
+	APIKey string `yaml:"api_key"`
+	// Public domain of this installation, sent as the Host header.
+	InstallationBaseURL string `yaml:"installation_base_url"`
+}
+
+// RateLimitConfig controls the per-client request limiter. The limit given
+// here applies to every request that none of Policies matches.
+type RateLimitConfig struct {
+	// Maximum number of requests allowed per window.
+	MaxRequests int `yaml:"max_requests"`
+	// Length of the rate limiting window.
+	Window Duration `yaml:"window"`
+	// Requests a client can make at once before being held to the average
+	// rate. Zero means max_requests.
+	Burst int `yaml:"burst"`
+	// Which requests share a bucket: "ip", "ip_path", "ip_collection" or
+	// "global".
+	GroupBy string `yaml:"group_by"`
+	// Client addresses or CIDR ranges that are never rate-limited.
+	Allowlist []string `yaml:"allowlist"`
+	// API keys by tier name. Clients sending one of these keys in the
+	// X-API-Key header are matched by policies listing that tier.
+	Tiers map[string][]string `yaml:"tiers"`
+	// Limits for particular routes, collections or tiers, checked in order.
+	Policies []RateLimitPolicy `yaml:"policies"`
+	// Where requests are counted: "local" (each replica on its own) or
+	// "redis" (shared by every replica using the same server and prefix).
+	Backend string `yaml:"backend"`
+	// Connection settings for the "redis" backend. An empty URL means the
+	// cache's Redis server.
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// RateLimitPolicy is a limit for the requests matching its routes,
+// collections and tiers. Zero window and group_by are taken from the
+// enclosing RateLimitConfig.
+type RateLimitPolicy struct {
+	// Name used in logs and metrics. Defaults to the policy's position.
+	Name string `yaml:"name"`
+	// Path prefixes, e.g. "/api/spins" or "/spin-events".
+	Routes []string `yaml:"routes"`
+	// Collection names, e.g. "spins" for /api/spins and its resources.
+	Collections []string `yaml:"collections"`
+	// Tiers from RateLimitConfig.Tiers. Empty matches every client.
+	Tiers       []string `yaml:"tiers"`
+	MaxRequests int      `yaml:"max_requests"`
+	Window      Duration `yaml:"window"`
+	Burst       int      `yaml:"burst"`
+	GroupBy     string   `yaml:"group_by"`
+}
+
+// CacheConfig controls the response cache.
+type CacheConfig struct {
+	// Storage backend: "memory" (lost on restart), "disk", or "redis"
+	// (shared between replicas).
+	Backend string `yaml:"backend"`
+	// Directory for the "disk" backend.
+	Dir string `yaml:"dir"`
+	// Connection settings for the "redis" backend.
+	Redis RedisConfig `yaml:"redis"`
+	// Maximum number of entries held at once.
+	MaxEntries int `yaml:"max_entries"`
+	// Upstream response headers stored with each entry and sent on hits and
+	// misses alike. A trailing "*" matches a prefix, e.g. "X-Pagination-*".
+	Headers []string `yaml:"headers"`
+	// How compressible bodies are stored: "gzip", "br" or "none".
+	Compression string `yaml:"compression"`
+	// TTL for anything without a more specific TTL. Zero disables caching
+	// of such responses.
+	DefaultTTL Duration `yaml:"default_ttl"`
+	// TTL for individual resources, e.g. /api/spins/1.
+	ResourceTTL Duration `yaml:"resource_ttl"`
+	// TTL per collection name, e.g. "spins" for /api/spins.
+	CollectionTTLs map[string]Duration `yaml:"collection_ttls"`
+	// TTL for resources of a collection, overriding ResourceTTL, e.g.
+	// "personas" for /api/personas/1.
+	ResourceTTLs map[string]Duration `yaml:"resource_ttls"`
+	// How long past its TTL an entry is served while being refreshed in the
+	// background.
+	StaleWhileRevalidate Duration `yaml:"stale_while_revalidate"`
+	// How long past its TTL an entry is served when Spinitron is failing.
+	StaleIfError Duration `yaml:"stale_if_error"`
+}
+
+// RedisConfig describes a Redis server.
+type RedisConfig struct {
+	// Connection URL, e.g. redis://:password@localhost:6379/0.
+	URL string `yaml:"url"`
+	// Prepended to every key. Replicas sharing a cache must use the same one.
+	Prefix string `yaml:"prefix"`
+}
+
+// ClientKeysConfig controls the API keys issued to the proxy's own clients.
+type ClientKeysConfig struct {
+	// File the keys and their usage are kept in. Empty disables client keys.
+	File string `yaml:"file"`
+	// Refuse /api/, /images/, /events and /spin-events requests without a
+	// valid key.
+	// When false, requests without a key are let through, which allows
+	// clients to be given keys before they are enforced.
+	Required bool `yaml:"required"`
+}
+
+// SSEConfig controls the /events and /spin-events streams.
+type SSEConfig struct {
+	// Number of events queued per connected client before it counts as slow.
+	ClientBuffer int `yaml:"client_buffer"`
+	// What to do with a slow client: "drop" skips events it has no room
+	// for, "disconnect" ends its stream so it reconnects and catches up from
+	// the history.
+	SlowClient string `yaml:"slow_client"`
+	// How long clients should wait before reconnecting, sent as the SSE
+	// "retry" field when they connect and when the server shuts down.
+	Retry Duration `yaml:"retry"`
+	// How often idle streams get a ": ping" comment. 0 disables heartbeats.
+	Heartbeat Duration `yaml:"heartbeat"`
+	// How long a stream may stay open (give or take 10%) before the client
+	// has to reconnect. 0 means no limit.
+	MaxLifetime Duration `yaml:"max_lifetime"`
+	// Streams allowed at once per client IP. 0 means no limit.
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// Number of recent events kept for clients that reconnect with a
+	// Last-Event-ID header. 0 disables replay.
+	History int `yaml:"history"`
+}
+
+// AdminConfig controls the /admin/ API.
+type AdminConfig struct {
+	// Bearer token required by every /admin/ endpoint. Empty disables the
+	// admin API entirely.
+	Token string `yaml:"token"`
+}
+
+// MetricsConfig controls the Prometheus /metrics endpoint.
+type MetricsConfig struct {
+	// Whether /metrics is served.
+	Enabled bool `yaml:"enabled"`
+}
+
+// LogConfig controls what is logged and how.
+type LogConfig struct {
+	// Minimum level logged: "debug", "info", "warn" or "error". Cache hits
+	// and sets are logged at debug.
+	Level string `yaml:"level"`
+	// Output format: "text" (key=value pairs) or "json" (one object per line).
+	Format string `yaml:"format"`
+}
+
+// TracingConfig controls OpenTelemetry tracing.
+type TracingConfig struct {
+	// Whether spans are recorded and exported. Off by default.
+	Enabled bool `yaml:"enabled"`
+	// OTLP/HTTP traces endpoint, e.g. "http://otel-collector:4318/v1/traces".
+	// Empty uses the standard OTEL_EXPORTER_OTLP_* environment variables.
+	Endpoint string `yaml:"endpoint"`
+	// Fraction of requests traced, from 0 to 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// Reported as the service.name resource attribute.
+	ServiceName string `yaml:"service_name"`
+}
+
+// ShutdownConfig controls what happens on SIGTERM or SIGINT.
+type ShutdownConfig struct {
+	// How long to wait for in-flight requests and background refreshes to
+	// finish before exiting anyway.
+	Timeout Duration `yaml:"timeout"`
+	// File the cache is saved to on shutdown and restored from on startup.
+	// Empty disables snapshots. Only allowed with the memory backend.
+	SnapshotFile string `yaml:"snapshot_file"`
+}
+
+// Duration wraps time.Duration so it can be written as "30s" or "5m" in the
+// config file and printed back the same way.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML parses a duration string such as "1m30s".
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", value.Line, value.Value)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalYAML writes the duration in its string form.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// MarshalJSON writes the duration in its string form, e.g. "1m".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON parses a duration string such as "1m30s".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Default returns the configuration used when nothing else is specified. It
+// mirrors the values that used to be hardcoded in main.go and cache.go.
+func Default() *Config {
+	return &Config{
+		Listen:         ":8080",
+		ClientIPHeader: clientip.DefaultHeader,
+		Upstream: UpstreamConfig{
+			URL: "https://spinitron.com",
+		},
+		RateLimit: RateLimitConfig{
+			MaxRequests: 60,
+			Window:      Duration{time.Minute},
+			GroupBy:     "ip_path",
+			Backend:     "local",
+			Redis: RedisConfig{
+				Prefix: "spinitron-proxy:ratelimit:",
+			},
+		},
+		Cache: CacheConfig{
+			Backend: "memory",
+			Dir:     "/var/cache/spinitron-proxy",
+			Redis: RedisConfig{
+				Prefix: "spinitron-proxy:",
+			},
+			MaxEntries: 2000,
+			Headers: []string{
+				"Content-Type",
+				"Content-Language",
+				"Content-Disposition",
+				"Link",
+				"X-Pagination-*",
+			},
+			Compression: "gzip",
+			DefaultTTL:  Duration{time.Minute},
+			ResourceTTL: Duration{3 * time.Minute},
+			CollectionTTLs: map[string]Duration{
+				"personas":  {5 * time.Minute},
+				"shows":     {5 * time.Minute},
+				"playlists": {3 * time.Minute},
+				"spins":     {30 * time.Second},
+			},
+			ResourceTTLs:         map[string]Duration{},
+			StaleWhileRevalidate: Duration{30 * time.Second},
+			StaleIfError:         Duration{10 * time.Minute},
+		},
+		SSE: SSEConfig{
+			ClientBuffer: 16,
+			SlowClient:   "disconnect",
+			Retry:        Duration{5 * time.Second},
+			Heartbeat:    Duration{15 * time.Second},
+			History:      100,
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+			ServiceName: "spinitron-proxy",
+		},
+		Shutdown: ShutdownConfig{
+			Timeout: Duration{15 * time.Second},
+		},
+	}
+}
+
+// Environment variables that override values from the config file.
+const (
+	EnvConfigFile      = "SPINITRON_PROXY_CONFIG"
+	EnvListen          = "LISTEN_ADDR"
+	EnvUpstreamURL     = "SPINITRON_BASE_URL"
+	EnvAPIKey          = "SPINITRON_API_KEY"
+	EnvInstallationURL = "INSTALLATION_BASE_URL"
+	EnvTriggerPassword = "TRIGGER_PASSWORD"
+	EnvAdminToken      = "ADMIN_TOKEN"
+	EnvRedisURL        = "REDIS_URL"
+	EnvRateLimitMax    = "RATE_LIMIT_MAX_REQUESTS"
+	EnvRateLimitWindow = "RATE_LIMIT_WINDOW"
+	EnvLogLevel        = "LOG_LEVEL"
+	EnvLogFormat       = "LOG_FORMAT"
+	EnvTrustedProxies  = "TRUSTED_PROXIES"
+	EnvClientIPHeader  = "CLIENT_IP_HEADER"
+)
+
+// Options holds flags that affect the program rather than the configuration.
+type Options struct {
+	// Path of the config file that was loaded, if any.
+	ConfigFile string
+	// Print the effective configuration and exit.
+	PrintConfig bool
+}
+
+// Load builds the effective configuration from defaults, the config file,
+// the environment (via getenv) and the command-line arguments (excluding the
+// program name). The result is not validated; call Validate for that.
+func Load(args []string, getenv func(string) string) (*Config, Options, error) {
+	var opts Options
+
+	fs := flag.NewFlagSet("spinitron-proxy", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigFile, "config", getenv(EnvConfigFile), "path to a YAML config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	listen := fs.String("listen", "", "address to listen on, e.g. :8080")
+	upstream := fs.String("upstream", "", "base URL of the Spinitron API")
+	maxRequests := fs.Int("rate-limit", 0, "maximum requests per client per window")
+	window := fs.Duration("rate-window", 0, "rate limiting window, e.g. 1m")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+
+	cfg := Default()
+
+	if opts.ConfigFile != "" {
+		if err := cfg.loadFile(opts.ConfigFile); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, opts, err
+	}
+
+	// Only flags that were explicitly given override earlier sources.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "upstream":
+			cfg.Upstream.URL = *upstream
+		case "rate-limit":
+			cfg.RateLimit.MaxRequests = *maxRequests
+		case "rate-window":
+			cfg.RateLimit.Window = Duration{*window}
+		}
+	})
+
+	return cfg, opts, nil
+}
+
+// loadFile decodes the YAML file at path on top of the current values.
+// Unknown keys are rejected so that typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides values with any environment variables that are set.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	if v := getenv(EnvListen); v != "" {
+		c.Listen = v
+	}
+	if v := getenv(EnvUpstreamURL); v != "" {
+		c.Upstream.URL = v
+	}
+	if v := getenv(EnvAPIKey); v != "" {
+		c.Upstream.APIKey = v
+	}
+	if v := getenv(EnvInstallationURL); v != "" {
+		c.Upstream.InstallationBaseURL = v
+	}
+	if v := getenv(EnvTriggerPassword); v != "" {
+		c.TriggerPassword = v
+	}
+	if v := getenv(EnvAdminToken); v != "" {
+		c.Admin.Token = v
+	}
+	if v := getenv(EnvRedisURL); v != "" {
+		c.Cache.Redis.URL = v
+	}
+	if v := getenv(EnvLogLevel); v != "" {
+		c.Log.Level = v
+	}
+	if v := getenv(EnvLogFormat); v != "" {
+		c.Log.Format = v
+	}
+	if v := getenv(EnvTrustedProxies); v != "" {
+		// A comma-separated list, e.g. "10.0.0.0/8,192.0.2.1".
+		c.TrustedProxies = strings.Split(v, ",")
+	}
+	if v := getenv(EnvClientIPHeader); v != "" {
+		c.ClientIPHeader = v
+	}
+	if v := getenv(EnvRateLimitMax); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", EnvRateLimitMax, err)
+		}
+		c.RateLimit.MaxRequests = n
+	}
+	if v := getenv(EnvRateLimitWindow); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", EnvRateLimitWindow, err)
+		}
+		c.RateLimit.Window = Duration{d}
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration at once, so that a
+// broken deployment can be fixed in a single pass.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Listen == "" {
+		errs = append(errs, errors.New("listen must not be empty"))
+	}
+
+	if u, err := url.Parse(c.Upstream.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("upstream.url %q is not an absolute URL", c.Upstream.URL))
+	}
+	if c.Upstream.APIKey == "" {
+		errs = append(errs, fmt.Errorf("upstream.api_key must be set (or %s)", EnvAPIKey))
+	}
+	if c.Upstream.InstallationBaseURL == "" {
+		errs = append(errs, fmt.Errorf("upstream.installation_base_url must be set (or %s)", EnvInstallationURL))
+	}
+
+	if _, err := clientip.New(c.TrustedProxies, c.ClientIPHeader); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies/client_ip_header: %w", err))
+	}
+	if c.RateLimit.MaxRequests <= 0 {
+		errs = append(errs, errors.New("rate_limit.max_requests must be positive"))
+	}
+	if c.RateLimit.Window.Duration <= 0 {
+		errs = append(errs, errors.New("rate_limit.window must be positive"))
+	}
+	if c.RateLimit.Burst < 0 {
+		errs = append(errs, errors.New("rate_limit.burst must not be negative"))
+	}
+	if !validGroupBy(c.RateLimit.GroupBy) {
+		errs = append(errs, fmt.Errorf("rate_limit.group_by %q must be one of ip, ip_path, ip_collection, global", c.RateLimit.GroupBy))
+	}
+	if _, err := clientip.ParseSet(c.RateLimit.Allowlist); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit.allowlist: %w", err))
+	}
+	if c.ClientKeys.Required && c.ClientKeys.File == "" {
+		errs = append(errs, errors.New("client_keys.file must be set when client_keys.required is true"))
+	}
+	switch c.RateLimit.Backend {
+	case "local":
+	case "redis":
+		if _, err := url.Parse(c.RateLimitRedisURL()); err != nil || c.RateLimitRedisURL() == "" {
+			errs = append(errs, fmt.Errorf("rate_limit.redis.url or cache.redis.url must be set for the redis backend (or %s)", EnvRedisURL))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rate_limit.backend %q must be one of local, redis", c.RateLimit.Backend))
+	}
+	for i, p := range c.RateLimit.Policies {
+		name := fmt.Sprintf("rate_limit.policies[%d]", i)
+		if p.MaxRequests <= 0 {
+			errs = append(errs, fmt.Errorf("%s.max_requests must be positive", name))
+		}
+		if p.Window.Duration < 0 {
+			errs = append(errs, fmt.Errorf("%s.window must not be negative", name))
+		}
+		if p.Burst < 0 {
+			errs = append(errs, fmt.Errorf("%s.burst must not be negative", name))
+		}
+		if p.GroupBy != "" && !validGroupBy(p.GroupBy) {
+			errs = append(errs, fmt.Errorf("%s.group_by %q must be one of ip, ip_path, ip_collection, global", name, p.GroupBy))
+		}
+		for _, tier := range p.Tiers {
+			if _, ok := c.RateLimit.Tiers[tier]; !ok {
+				errs = append(errs, fmt.Errorf("%s.tiers: unknown tier %q", name, tier))
+			}
+		}
+	}
+
+	switch c.Cache.Backend {
+	case "memory":
+	case "disk":
+		if c.Cache.Dir == "" {
+			errs = append(errs, errors.New("cache.dir must be set for the disk backend"))
+		}
+	case "redis":
+		if _, err := url.Parse(c.Cache.Redis.URL); err != nil || c.Cache.Redis.URL == "" {
+			errs = append(errs, fmt.Errorf("cache.redis.url must be set for the redis backend (or %s)", EnvRedisURL))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache.backend %q must be one of memory, disk, redis", c.Cache.Backend))
+	}
+	switch c.Cache.Compression {
+	case "none", "gzip", "br":
+	default:
+		errs = append(errs, fmt.Errorf("cache.compression %q must be one of none, gzip, br", c.Cache.Compression))
+	}
+	if c.Cache.MaxEntries <= 0 {
+		errs = append(errs, errors.New("cache.max_entries must be positive"))
+	}
+	if c.Cache.DefaultTTL.Duration < 0 {
+		errs = append(errs, errors.New("cache.default_ttl must not be negative"))
+	}
+	if c.Cache.ResourceTTL.Duration < 0 {
+		errs = append(errs, errors.New("cache.resource_ttl must not be negative"))
+	}
+	for name, ttl := range c.Cache.CollectionTTLs {
+		if ttl.Duration < 0 {
+			errs = append(errs, fmt.Errorf("cache.collection_ttls.%s must not be negative", name))
+		}
+	}
+	for name, ttl := range c.Cache.ResourceTTLs {
+		if ttl.Duration < 0 {
+			errs = append(errs, fmt.Errorf("cache.resource_ttls.%s must not be negative", name))
+		}
+	}
+	if c.Cache.StaleWhileRevalidate.Duration < 0 {
+		errs = append(errs, errors.New("cache.stale_while_revalidate must not be negative"))
+	}
+	if c.Cache.StaleIfError.Duration < 0 {
+		errs = append(errs, errors.New("cache.stale_if_error must not be negative"))
+	}
+
+	if c.SSE.ClientBuffer < 1 {
+		errs = append(errs, errors.New("sse.client_buffer must be at least 1"))
+	}
+	if c.SSE.Retry.Duration < 0 {
+		errs = append(errs, errors.New("sse.retry must not be negative"))
+	}
+	switch c.SSE.SlowClient {
+	case "drop", "disconnect":
+	default:
+		errs = append(errs, fmt.Errorf("sse.slow_client %q must be one of drop, disconnect", c.SSE.SlowClient))
+	}
+	if c.SSE.Heartbeat.Duration < 0 {
+		errs = append(errs, errors.New("sse.heartbeat must not be negative"))
+	}
+	if c.SSE.MaxLifetime.Duration < 0 {
+		errs = append(errs, errors.New("sse.max_lifetime must not be negative"))
+	}
+	if c.SSE.MaxConnectionsPerIP < 0 {
+		errs = append(errs, errors.New("sse.max_connections_per_ip must not be negative"))
+	}
+	if c.SSE.History < 0 {
+		errs = append(errs, errors.New("sse.history must not be negative"))
+	}
+	if c.Shutdown.Timeout.Duration <= 0 {
+		errs = append(errs, errors.New("shutdown.timeout must be positive"))
+	}
+	// Restoring a snapshot into a shared or persistent store would overwrite
+	// fresher entries with the ones saved by this replica.
+	if c.Shutdown.SnapshotFile != "" && c.Cache.Backend != "memory" {
+		errs = append(errs, fmt.Errorf("shutdown.snapshot_file can only be used with the memory cache backend, not %q", c.Cache.Backend))
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level %q must be one of debug, info, warn, error", c.Log.Level))
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format %q must be one of text, json", c.Log.Format))
+	}
+
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint != "" {
+			if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				errs = append(errs, fmt.Errorf("tracing.endpoint %q is not an absolute URL", c.Tracing.Endpoint))
+			}
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			errs = append(errs, errors.New("tracing.sample_ratio must be between 0 and 1"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RateLimitRedisURL returns the URL of the Redis server for the rate limiter,
+// which is the cache's unless one is given.
+func (c *Config) RateLimitRedisURL() string {
+	if c.RateLimit.Redis.URL != "" {
+		return c.RateLimit.Redis.URL
+	}
+	return c.Cache.Redis.URL
+}
+
+// validGroupBy reports whether s is a rate limit grouping.
+func validGroupBy(s string) bool {
+	switch s {
+	case "ip", "ip_path", "ip_collection", "global":
+		return true
+	}
+	return false
+}
+
+// Print writes the configuration as YAML with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	redacted.Upstream.APIKey = redact(c.Upstream.APIKey)
+	redacted.TriggerPassword = redact(c.TriggerPassword)
+	redacted.Admin.Token = redact(c.Admin.Token)
+	redacted.Cache.Redis.URL = redactURL(c.Cache.Redis.URL)
+	redacted.RateLimit.Redis.URL = redactURL(c.RateLimit.Redis.URL)
+	if c.RateLimit.Tiers != nil {
+		redacted.RateLimit.Tiers = make(map[string][]string, len(c.RateLimit.Tiers))
+		for tier, keys := range c.RateLimit.Tiers {
+			for _, key := range keys {
+				redacted.RateLimit.Tiers[tier] = append(redacted.RateLimit.Tiers[tier], redact(key))
+			}
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(&redacted)
+}
+
+// redact hides a secret while still showing whether it is set.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return strings.Repeat("*", 8)
+}
+
+// redactURL hides the password in a URL, if it has one.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redact("x"))
+	}
+	return u.String()
+}
+
+// Durations converts a map of config durations to plain time.Durations.
+func Durations(m map[string]Duration) map[string]time.Duration {
+	out := make(map[string]time.Duration, len(m))
+	for k, v := range m {
+		out[k] = v.Duration
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a getenv function backed by the given map.
+func env(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+// Checks that defaults match the values that used to be hardcoded.
+func TestDefaults(t *testing.T) {
+	cfg, _, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":8080" {
+		t.Errorf("Listen = %q; want :8080", cfg.Listen)
+	}
+	if cfg.RateLimit.MaxRequests != 60 || cfg.RateLimit.Window.Duration != time.Minute {
+		t.Errorf("RateLimit = %+v; want 60 per 1m", cfg.RateLimit)
+	}
+	if got := cfg.Cache.CollectionTTLs["spins"].Duration; got != 30*time.Second {
+		t.Errorf("spins TTL = %s; want 30s", got)
+	}
+}
+
+// Checks that the file, environment and flags are applied in order of
+// increasing precedence.
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yml := `
+listen: ":9000"
+upstream:
+  url: https://file.example
+rate_limit:
+  max_requests: 10
+cache:
+  collection_ttls:
+    spins: 10s
+`
+	if err := os.WriteFile(path, []byte(yml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, opts, err := Load(
+		[]string{"-config", path, "-rate-limit", "5"},
+		env(map[string]string{EnvUpstreamURL: "https://env.example"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.ConfigFile != path {
+		t.Errorf("ConfigFile = %q; want %q", opts.ConfigFile, path)
+	}
+	if cfg.Listen != ":9000" {
+		t.Errorf("Listen = %q; want :9000 from file", cfg.Listen)
+	}
+	if cfg.Upstream.URL != "https://env.example" {
+		t.Errorf("Upstream.URL = %q; want env override", cfg.Upstream.URL)
+	}
+	if cfg.RateLimit.MaxRequests != 5 {
+		t.Errorf("MaxRequests = %d; want 5 from flag", cfg.RateLimit.MaxRequests)
+	}
+	if got := cfg.Cache.CollectionTTLs["spins"].Duration; got != 10*time.Second {
+		t.Errorf("spins TTL = %s; want 10s from file", got)
+	}
+	// Collections not mentioned in the file keep their defaults.
+	if got := cfg.Cache.CollectionTTLs["shows"].Duration; got != 5*time.Minute {
+		t.Errorf("shows TTL = %s; want default 5m", got)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("lisen: \":9000\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Load([]string{"-config", path}, env(nil)); err == nil {
+		t.Error("Load() with unknown key returned nil error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() without API key returned nil error")
+	}
+
+	cfg.Upstream.APIKey = "key"
+	cfg.Upstream.InstallationBaseURL = "example.org"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v; want nil", err)
+	}
+
+	cfg.RateLimit.MaxRequests = 0
+	cfg.Upstream.URL = "not a url"
+	cfg.Log.Format = "xml"
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	cfg.RateLimit.Policies = []RateLimitPolicy{{MaxRequests: 10, GroupBy: "ip_path", Tiers: []string{"gold"}}}
+	cfg.SSE.SlowClient = "block"
+	cfg.Cache.Backend = "redis"
+	cfg.Shutdown.SnapshotFile = "/tmp/cache.snapshot"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() with bad values returned nil error")
+	}
+	for _, want := range []string{"rate_limit.max_requests", "upstream.url", "log.format", "trusted_proxies", "rate_limit.policies[0].tiers", "sse.slow_client", "shutdown.snapshot_file"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %q; want mention of %s", err, want)
+		}
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Upstream.APIKey = "super-secret"
+	cfg.RateLimit.Tiers = map[string][]string{"partner": {"partner-secret"}}
+
+	var sb strings.Builder
+	if err := cfg.Print(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	out := sb.String()
+	if strings.Contains(out, "super-secret") {
+		t.Errorf("Print() leaked the API key:\n%s", out)
+	}
+	if strings.Contains(out, "partner-secret") {
+		t.Errorf("Print() leaked a rate limit tier key:\n%s", out)
+	}
+	if !strings.Contains(out, "spins: 30s") {
+		t.Errorf("Print() = %q; want durations as strings", out)
+	}
+}
@@ -0,0 +1,63 @@
+// Package logging sets up the proxy's structured logger (log/slog) and tags
+// every request with an ID that is included in all of its log lines.
+//
+// Log lines use the same field names throughout, so that they can be
+// filtered on in a log pipeline:
+//
+//	request_id  ID of the HTTP request being handled
+//	key         cache key, e.g. "/api/spins?page=2"
+//	collection  collection the key belongs to, e.g. "spins"
+//	duration    how long the operation took
+//	client_ip   address of the client
+//	status      HTTP status code
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// New returns a logger writing to w in the given format ("text" or "json"),
+// dropping records below level ("debug", "info", "warn" or "error"). Records
+// logged with a request's context carry its request_id.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return nil, fmt.Errorf("logging: unknown level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// contextHandler adds the request ID stored in a record's context, if any.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// capture makes the default logger write JSON to the returned buffer for the
+// rest of the test.
+func capture(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestNewRejectsUnknownSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("New() with format xml returned nil error")
+	}
+	if _, err := New(&bytes.Buffer{}, "text", "loud"); err == nil {
+		t.Error("New() with level loud returned nil error")
+	}
+}
+
+func TestMiddlewareAssignsRequestID(t *testing.T) {
+	buf := capture(t, "info")
+
+	var seen string
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		slog.InfoContext(r.Context(), "handler.ran")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/spins", nil))
+
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" || id != seen {
+		t.Fatalf("X-Request-ID = %q, handler saw %q; want the same non-empty ID", id, seen)
+	}
+
+	// Both the handler's line and the access log carry the ID.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines; want 2:\n%s", len(lines), buf)
+	}
+	for _, line := range lines {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["request_id"] != id {
+			t.Errorf("log line %s has request_id %v; want %s", line, rec["request_id"], id)
+		}
+	}
+
+	var access map[string]any
+	_ = json.Unmarshal([]byte(lines[1]), &access)
+	if access["msg"] != "http.request" || access["status"] != float64(http.StatusTeapot) {
+		t.Errorf("access log = %s", lines[1])
+	}
+}
+
+func TestMiddlewareReusesValidRequestID(t *testing.T) {
+	capture(t, "info")
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		sent  string
+		reuse bool
+	}{
+		{"abc-123", true},
+		{"has spaces", false},
+		{strings.Repeat("x", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIDHeader, tt.sent)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get(RequestIDHeader); (got == tt.sent) != tt.reuse {
+			t.Errorf("sent %q, got back %q; reuse = %t", tt.sent, got, tt.reuse)
+		}
+	}
+}
+
+func TestMiddlewareQuietPaths(t *testing.T) {
+	buf := capture(t, "info")
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/healthz")
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	if buf.Len() != 0 {
+		t.Errorf("/healthz logged at info: %s", buf)
+	}
+}
+
+func TestMiddlewareRedactsSecrets(t *testing.T) {
+	buf := capture(t, "info")
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/trigger/spins?x=1&pw=hunter2&api_key=spk_abc", nil))
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, buf)
+	}
+	if got, want := rec["path"], "/trigger/spins?x=1&pw=REDACTED&api_key=REDACTED"; got != want {
+		t.Errorf("path = %v, want %v", got, want)
+	}
+}
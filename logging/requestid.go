@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+)
+
+// RequestIDHeader carries the request ID. An ID sent by the client (or a load
+// balancer in front of us) is reused; otherwise one is generated. Either way
+// it is echoed back in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds IDs accepted from clients, which end up in every
+// log line of the request.
+const maxRequestIDLength = 128
+
+// redactedParams are query parameters whose values are secrets, such as the
+// /trigger/spins password and client keys (clientkeys.QueryParam), and are
+// left out of request logs.
+var redactedParams = []string{"pw", "api_key"}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random 16-character hex ID.
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a client-supplied ID is safe to log as-is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// logPath returns the path and query of u as logged, with the values of
+// redactedParams replaced. The order of the other parameters is kept.
+func logPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		name, _, _ := strings.Cut(p, "=")
+		if name, err := url.QueryUnescape(name); err == nil && slices.Contains(redactedParams, name) {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return u.EscapedPath() + "?" + strings.Join(params, "&")
+}
+
+// Middleware assigns each request an ID, stores it in the request's context
+// and the X-Request-ID response header, and logs the request once it has been
+// handled, without the values of secret query parameters. Requests for
+// quietPaths (e.g. health checks) are logged at debug level only.
+func Middleware(next http.Handler, quietPaths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tick := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+
+		rec := NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if slices.Contains(quietPaths, r.URL.Path) {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "http.request",
+			"method", r.Method,
+			"path", logPath(r.URL),
+			"status", rec.Status(),
+			"duration", time.Since(tick),
+			"client_ip", clientip.FromRequest(r),
+		)
+	})
+}
+
+// StatusRecorder is an http.ResponseWriter that remembers the status code
+// written through it, for middleware that reports on responses. It forwards
+// Flush, so that streaming handlers such as /spin-events keep working.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// NewStatusRecorder wraps w.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status returns the status code written so far (200 if none was written
+// explicitly).
+func (r *StatusRecorder) Status() int {
+	return r.status
+}
+
+func (r *StatusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *StatusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -1,21 +1,33 @@
 package main
 
 import (
+	"context"
 	"crypto/subtle"
-	"io"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"net/http"
 	"net/url"
 
+	"github.com/wbor-fm/spinitron-proxy/admin"
+	"github.com/wbor-fm/spinitron-proxy/cache"
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/clientkeys"
+	"github.com/wbor-fm/spinitron-proxy/config"
+	"github.com/wbor-fm/spinitron-proxy/logging"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
 	"github.com/wbor-fm/spinitron-proxy/proxy"
 	"github.com/wbor-fm/spinitron-proxy/ratelimiter"
-)
+	"github.com/wbor-fm/spinitron-proxy/sse"
+	"github.com/wbor-fm/spinitron-proxy/tracing"
 
-const tokenEnvVarName = "SPINITRON_API_KEY"
-const spinitronBaseURL = "https://spinitron.com"
+	"github.com/redis/go-redis/v9"
+)
 
 // healthzHandler responds with a simple OK for health checks.
 func healthzHandler(w http.ResponseWriter, r *http.Request) {
@@ -23,24 +35,253 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// discardResponseWriter is an http.ResponseWriter that keeps only the status
+// of the response written to it.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// newRateLimitPolicies builds the rate limit policies described by cfg, which
+// has already been validated. If client is not nil, requests are counted in
+// Redis, with each policy's local limiter as a fallback. If keys is not nil,
+// client keys with a rate limit of their own are held to it, and the others
+// to the policies for their tier.
+func newRateLimitPolicies(cfg config.RateLimitConfig, client *redis.Client, keys *clientkeys.Store) *ratelimiter.Policies {
+	newLimiter := func(name string, max int, window time.Duration, burst int) ratelimiter.Limiter {
+		rl := ratelimiter.NewRateLimiter(max, window)
+		rl.Burst = burst
+		if client != nil {
+			return ratelimiter.NewRedisLimiter(client, cfg.Redis.Prefix+name+":", rl)
+		}
+		return rl
+	}
+	newPolicy := func(name string, max int, window time.Duration, burst int, groupBy string) *ratelimiter.Policy {
+		return &ratelimiter.Policy{Name: name, GroupBy: ratelimiter.GroupBy(groupBy), Limiter: newLimiter(name, max, window, burst)}
+	}
+
+	allowlist, _ := clientip.ParseSet(cfg.Allowlist)
+	ps := &ratelimiter.Policies{
+		Default:   newPolicy("default", cfg.MaxRequests, cfg.Window.Duration, cfg.Burst, cfg.GroupBy),
+		Allowlist: allowlist,
+		Tier:      ratelimiter.KeyTiers(cfg.Tiers),
+	}
+	for i, pc := range cfg.Policies {
+		name := pc.Name
+		if name == "" {
+			name = fmt.Sprintf("policy-%d", i)
+		}
+		window := pc.Window.Duration
+		if window == 0 {
+			window = cfg.Window.Duration
+		}
+		groupBy := pc.GroupBy
+		if groupBy == "" {
+			groupBy = cfg.GroupBy
+		}
+		p := newPolicy(name, pc.MaxRequests, window, pc.Burst, groupBy)
+		p.Routes = pc.Routes
+		p.Collections = pc.Collections
+		p.Tiers = pc.Tiers
+		ps.Policies = append(ps.Policies, p)
+	}
+
+	if keys != nil {
+		keys.NewLimiter = func(name string, l clientkeys.Limit) ratelimiter.Limiter {
+			return newLimiter(name, l.MaxRequests, l.Window.Duration, 0)
+		}
+		ps.Client = keys.Policy
+		configTiers := ps.Tier
+		ps.Tier = func(r *http.Request) string {
+			if k, ok := clientkeys.FromRequest(r); ok && k.Tier != "" {
+				return k.Tier
+			}
+			return configTiers(r)
+		}
+	}
+	return ps
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
-	// Parse the base URL for Spinitron using the net/url package.
-	// Parse() returns a URL struct and an error if there is one, but here we're
-	// ignoring the error with the underscore since we know the URL is valid (as
-	// it is hardcoded).
-	// If the URL were to be provided by the user, we would need to handle the
-	// error and return a message to the user.
-	parsedURL, _ := url.Parse(spinitronBaseURL)
+	// Build the configuration from defaults, an optional config file,
+	// environment variables and command-line flags (in that order).
+	cfg, opts, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	// From here on, everything (including the standard library's log
+	// package) logs through slog in the configured format.
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// Tracing is off unless configured; spans are then no-ops.
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Enabled {
+		shutdownTracing, err = tracing.Setup(context.Background(), tracing.Options{
+			ServiceName: cfg.Tracing.ServiceName,
+			Endpoint:    cfg.Tracing.Endpoint,
+			SampleRatio: cfg.Tracing.SampleRatio,
+		})
+		if err != nil {
+			fatal("tracing.setup failed", err)
+		}
+	}
+
+	// Parse the base URL for Spinitron using the net/url package. Validate()
+	// has already checked that it is an absolute URL.
+	parsedURL, err := url.Parse(cfg.Upstream.URL)
+	if err != nil {
+		fatal("config.upstream", err)
+	}
+
+	// Pick where cached responses are stored. The disk backend restores
+	// entries from the previous run so a restart doesn't start cold.
+	var store cache.Store
+	switch cfg.Cache.Backend {
+	case "disk":
+		store, err = cache.OpenDiskStore(cfg.Cache.Dir, cfg.Cache.MaxEntries)
+		if err != nil {
+			fatal("cache.disk.open failed", err)
+		}
+	case "redis":
+		// A shared store lets every replica see the same entries, so a
+		// /trigger/spins hit on one refreshes them all.
+		redisOpts, err := redis.ParseURL(cfg.Cache.Redis.URL)
+		if err != nil {
+			fatal("config.redis", err)
+		}
+		store = cache.NewRedisStore(redis.NewClient(redisOpts), cfg.Cache.Redis.Prefix)
+	default:
+		store = cache.NewMemoryStore(cfg.Cache.MaxEntries)
+	}
+
+	// Initialize the cache to store responses using the cache package we
+	// defined in cache/cache.go.
+	// The TTL policy can later be changed at runtime through /admin/ttl.
+	compression := cfg.Cache.Compression
+	if compression == "none" {
+		compression = cache.EncodingIdentity
+	}
+
+	c := &cache.Cache{
+		Store:       store,
+		Headers:     cfg.Cache.Headers,
+		Compression: compression,
+		TTLs: cache.NewTTLPolicy(cache.TTLTable{
+			Default:     cfg.Cache.DefaultTTL.Duration,
+			Resource:    cfg.Cache.ResourceTTL.Duration,
+			Collections: config.Durations(cfg.Cache.CollectionTTLs),
+			Resources:   config.Durations(cfg.Cache.ResourceTTLs),
+		}),
+		StaleWhileRevalidate: cfg.Cache.StaleWhileRevalidate.Duration,
+		StaleIfError:         cfg.Cache.StaleIfError.Duration,
+	}
+	c.Init()
+
+	// Warm the cache up with what the previous run saved on shutdown.
+	if cfg.Shutdown.SnapshotFile != "" {
+		if _, err := c.LoadSnapshot(cfg.Shutdown.SnapshotFile); err != nil {
+			slog.Warn("cache.snapshot.load failed", "error", err)
+		}
+	}
 
 	// Create a new reverse proxy that injects the API token.
-	revProxy := proxy.NewReverseProxy(tokenEnvVarName, parsedURL)
-	proxy.OnSpinsUpdate = BroadcastSpinMessage
+	revProxy := proxy.NewReverseProxy(parsedURL, cfg.Upstream.APIKey, cfg.Upstream.InstallationBaseURL, c)
+	proxy.OnCollectionUpdate = BroadcastUpdate
+
+	// Client IPs (used for rate limiting and logs) are read from forwarding
+	// headers only when a request comes from one of the trusted proxies.
+	// Validate has already checked the list.
+	resolver, err := clientip.New(cfg.TrustedProxies, cfg.ClientIPHeader)
+	if err != nil {
+		fatal("invalid trusted_proxies", err)
+	}
+
+	// Rate limit requests by the configured policies, falling back to the
+	// top-level limit for requests none of them matches.
+	// With the redis backend, requests are counted in Redis so that the
+	// limits hold across replicas, and locally while Redis is unreachable.
+	// Client keys, if enabled, identify the proxy's own clients. Their usage
+	// is saved periodically and on shutdown.
+	var keys *clientkeys.Store
+	if cfg.ClientKeys.File != "" {
+		keys, err = clientkeys.Open(cfg.ClientKeys.File)
+		if err != nil {
+			fatal("clientkeys.open failed", err)
+		}
+	}
+
+	var rateLimitRedis *redis.Client
+	if cfg.RateLimit.Backend == "redis" {
+		redisOpts, err := redis.ParseURL(cfg.RateLimitRedisURL())
+		if err != nil {
+			fatal("config.rate_limit.redis", err)
+		}
+		rateLimitRedis = redis.NewClient(redisOpts)
+		defer rateLimitRedis.Close()
+	}
+	rateLimiter := newRateLimitPolicies(cfg.RateLimit, rateLimitRedis, keys)
+
+	// protect puts a public route behind the client key check, if enabled,
+	// and the rate limiter.
+	protect := func(h http.Handler) http.Handler {
+		h = rateLimiter.Middleware(h)
+		if keys != nil {
+			h = keys.Middleware(cfg.ClientKeys.Required, h)
+		}
+		return h
+	}
 
-	// Create a new rate limiter with a maximum of 60 requests per minute.
-	rateLimiter := ratelimiter.NewRateLimiter(60, time.Minute)
+	// SSE clients each get a queue of this size, are dropped or
+	// disconnected when it is full, are sent the events they missed when
+	// they reconnect, if still in the history, and are told to reconnect
+	// after Retry. Idle streams get heartbeats, and streams can be limited
+	// in how long they last and how many one address may open. Clients can
+	// subscribe to any of the event types BroadcastUpdate sends.
+	eventHub = sse.NewHub(cfg.SSE.History)
+	eventHub.Types = []string{"spin", "playlist", "show"}
+	eventHub.ClientBuffer = cfg.SSE.ClientBuffer
+	eventHub.SlowClient = sse.SlowClientPolicy(cfg.SSE.SlowClient)
+	eventHub.Retry = cfg.SSE.Retry.Duration
+	eventHub.Heartbeat = cfg.SSE.Heartbeat.Duration
+	eventHub.MaxLifetime = cfg.SSE.MaxLifetime.Duration
+	eventHub.MaxPerIP = cfg.SSE.MaxConnectionsPerIP
 
-	// Get the trigger password from environment variables
-	triggerPassword := os.Getenv("TRIGGER_PASSWORD")
+	triggerPassword := cfg.TriggerPassword
 
 	// Register the health check handler for the /healthz endpoint, not rate-limited.
 	http.HandleFunc("/healthz", healthzHandler)
@@ -48,11 +289,25 @@ func main() {
 	// Normal proxy routes: /api/ and /images/
 	// Register HTTP handlers so that any GET requests to /api/ or /images/ go
 	// through our custom reverse proxy (the proxy we created above).
-	http.Handle("GET /api/", rateLimiter.Middleware(revProxy))
-	http.Handle("GET /images/", rateLimiter.Middleware(revProxy))
+	http.Handle("GET /api/", protect(revProxy))
+	http.Handle("GET /images/", protect(revProxy))
 
-	// SSE Endpoint.
-	http.HandleFunc("/spin-events", rateLimiter.MiddlewareFunc(spinEventsHandler))
+	// Admin API, only available when an admin token is configured. It is not
+	// rate-limited since every request must be authenticated.
+	if cfg.Admin.Token != "" {
+		adminAPI := &admin.API{Token: cfg.Admin.Token, Cache: c, Keys: keys}
+		http.Handle("/admin/", adminAPI.Handler())
+	}
+
+	// Prometheus metrics, not rate-limited so scrapes never fail.
+	if cfg.Metrics.Enabled {
+		http.Handle("GET /metrics", metrics.Handler())
+	}
+
+	// SSE Endpoints. /events streams every event type by default, and
+	// /spin-events, which predates the others, only spins.
+	http.Handle("/events", protect(eventHub))
+	http.Handle("/spin-events", protect(eventHub.Stream("spin")))
 
 	// POST route to trigger an internal GET request for /api/spins to force a
 	// refresh of the cache. This is used by Spinitron to trigger a refresh of
@@ -71,45 +326,98 @@ func main() {
 			
 			//  Use constant-time comparison to prevent timing attacks
 			if subtle.ConstantTimeCompare(providedPassword, secretPassword) != 1 {
-				log.Println("trigger.spins unauthorized: password mismatch")
+				slog.WarnContext(r.Context(), "trigger.spins unauthorized", "client_ip", clientip.FromRequest(r))
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 		}
 
-		log.Println("trigger.spins")
+		slog.InfoContext(r.Context(), "trigger.spins", "client_ip", clientip.FromRequest(r))
 
-		// This request goes back into our own server, ensuring the proxy logic
-		// is used. The key part is `?forceRefresh=1`.
-		resp, err := http.Get("http://localhost:8080/api/spins?forceRefresh=1")
+		// This request is served by the reverse proxy in-process, rather than
+		// over HTTP, so that the client key check and rate limiter don't apply
+		// to it. The key part is `?forceRefresh=1`. It shares our context, and
+		// with it the request ID and trace.
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, "/api/spins?forceRefresh=1", nil)
 		if err != nil {
 			http.Error(w, "Failed to fetch spins: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer resp.Body.Close()
-		// Read entire body so that the data flows through to our caching
-		// mechanism. TL;DR: this line is important because without it, the
-		// response body is not read and the cache is not updated! Reading the
-		// body is necessary to update the cache since the cache is updated in
-		// the proxy logic via `t.Cache.Set(key, data)` which is called when the
-		// response status is OK (handled in proxy.go).
-		_, _ = io.ReadAll(resp.Body)
+		// The proxy reads the entire upstream body while copying it to rw,
+		// which is what updates the cache (see proxy.go).
+		rw := &discardResponseWriter{header: http.Header{}}
+		revProxy.ServeHTTP(rw, req)
+		if rw.status != http.StatusOK {
+			slog.WarnContext(r.Context(), "trigger.spins refresh failed", "status", rw.status)
+			http.Error(w, fmt.Sprintf("Failed to fetch spins: upstream returned %d", rw.status), http.StatusBadGateway)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Forced refresh of /api/spins. Cache updated."))
 	}))
 
-	log.Println("spinitron-proxy started on port 8080, health check available at /healthz")
+	// Every request has its client IP resolved, is given a request ID and
+	// logged once it is done, and traced if tracing is enabled.
+	srv := &http.Server{
+		Addr: cfg.Listen,
+		Handler: clientip.Middleware(resolver,
+			logging.Middleware(tracing.Middleware(http.DefaultServeMux), "/healthz", "/metrics")),
+	}
+	// SSE streams never end on their own, so Shutdown would wait on them
+	// until its deadline. Close them as soon as it starts instead.
+	srv.RegisterOnShutdown(eventHub.Close)
 
-	// Listen on port 8080 for incoming HTTP requests. If there's an error, it
-	// returns a non-nil error (nil means no error).
-	// The `:=` operator is shorthand for declaring and initializing a variable
-	// in one line. It is equivalent to:
-	//   var err error
-	//   err = http.ListenAndServe(":8080", nil)
-	err := http.ListenAndServe(":8080", nil)
+	// Docker stops containers with SIGTERM; Ctrl-C sends SIGINT.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// If ListenAndServe returns an error, panic is called to log it and exit
-	// the program.
-	panic(err)
+	// Listen on the configured address for incoming HTTP requests in the
+	// background, so that we can wait for a signal here.
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	slog.Info("spinitron-proxy started", "listen", cfg.Listen, "healthz", "/healthz")
+
+	select {
+	case err := <-serveErr:
+		// The server never started (e.g. the port is taken).
+		fatal("server.listen failed", err)
+	case <-ctx.Done():
+	}
+	stop() // A second signal kills the process right away.
+	slog.Info("server.shutdown", "timeout", cfg.Shutdown.Timeout.Duration)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout.Duration)
+	defer cancel()
+
+	// Stop accepting connections and wait for in-flight requests, then for
+	// background refreshes so that their results make it into the cache.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("server.shutdown timed out", "error", err)
+	}
+	if t, ok := revProxy.Transport.(*proxy.TransportWithCache); ok {
+		if err := t.Drain(shutdownCtx); err != nil {
+			slog.Warn("proxy.drain timed out", "error", err)
+		}
+	}
+
+	if cfg.Shutdown.SnapshotFile != "" {
+		if _, err := c.SaveSnapshot(cfg.Shutdown.SnapshotFile); err != nil {
+			slog.Error("cache.snapshot.save failed", "error", err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		slog.Warn("cache.close failed", "error", err)
+	}
+	if keys != nil {
+		if err := keys.Close(); err != nil {
+			slog.Warn("clientkeys.close failed", "error", err)
+		}
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("tracing.shutdown failed", "error", err)
+	}
+	slog.Info("server.stopped")
 }
@@ -0,0 +1,153 @@
+// Package metrics defines the Prometheus metrics exported by the proxy at
+// /metrics. The other packages record into the variables below; main mounts
+// Handler.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
+)
+
+const namespace = "spinitron_proxy"
+
+// Registry holds every metric below, plus the standard Go runtime and process
+// collectors. A dedicated registry (rather than the global default) keeps
+// tests and library code from leaking metrics into ours.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	// CacheLookups counts cache lookups by collection and result: "hit" for
+	// a fresh entry, "stale" for an expired one still in its grace window,
+	// and "miss".
+	CacheLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "lookups_total",
+		Help:      "Cache lookups by collection and result (hit, stale, miss).",
+	}, []string{"collection", "result"})
+
+	// CacheEvictions counts entries removed from the cache by collection and
+	// reason: "expired" once an entry's grace window is over, "collection"
+	// when removed along with its expiring collection, "purged" through the
+	// admin API and "flushed" when the whole cache is emptied.
+	CacheEvictions = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Entries removed from the cache by collection and reason.",
+	}, []string{"collection", "reason"})
+
+	// UpstreamDuration observes how long Spinitron takes to answer, including
+	// reading the body.
+	UpstreamDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of upstream requests by collection.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"collection"})
+
+	// UpstreamResponses counts upstream responses by collection and status
+	// code, with "error" when no response was received.
+	UpstreamResponses = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "responses_total",
+		Help:      "Upstream responses by collection and status code.",
+	}, []string{"collection", "code"})
+
+	// UpstreamCoalesced counts cache misses that were answered by a fetch
+	// already in flight instead of making their own.
+	UpstreamCoalesced = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "coalesced_total",
+		Help:      "Cache misses served by an upstream request already in flight.",
+	})
+
+	// RateLimitRejections counts requests denied by the rate limiter, by route
+	// and the name of the policy that denied them.
+	RateLimitRejections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ratelimit",
+		Name:      "rejections_total",
+		Help:      "Requests rejected by the rate limiter by route and policy.",
+	}, []string{"route", "policy"})
+
+	// SSEClients is the number of clients connected to /events and
+	// /spin-events.
+	SSEClients = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "sse",
+		Name:      "clients",
+		Help:      "Clients connected to the SSE streams.",
+	})
+
+	// SSEDroppedEvents counts events not delivered to a client because its
+	// queue was full, by the slow client policy applied: "drop" skips the
+	// event, "disconnect" also ends the client's stream.
+	SSEDroppedEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "sse",
+		Name:      "dropped_events_total",
+		Help:      "Events not delivered to slow SSE clients by policy.",
+	}, []string{"policy"})
+)
+
+// Handler serves the metrics in Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// knownCollections are the collections used as label values. Anything else
+// is reported as "other", so that requests for made-up paths can't create an
+// unbounded number of time series.
+var knownCollections = map[string]bool{
+	"personas":  true,
+	"shows":     true,
+	"playlists": true,
+	"spins":     true,
+	"images":    true,
+}
+
+// Collection returns the collection label for a cache key or request path,
+// e.g. "spins" for "/api/spins/123".
+func Collection(path string) string {
+	if name := api.GetCollectionName(path); knownCollections[name] {
+		return name
+	}
+	return "other"
+}
+
+// Route returns the route label for a request path: "/api/" followed by the
+// collection for API requests, "/images/" for images, "/admin/" for the admin
+// API and the path itself for the proxy's other endpoints.
+func Route(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/"):
+		return "/api/" + Collection(path)
+	case strings.HasPrefix(path, "/images/"):
+		return "/images/"
+	case strings.HasPrefix(path, "/admin/"):
+		return "/admin/"
+	case path == "/events", path == "/spin-events", path == "/trigger/spins", path == "/healthz", path == "/metrics":
+		return path
+	}
+	return "other"
+}
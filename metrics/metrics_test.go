@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		path       string
+		collection string
+		route      string
+	}{
+		{"/api/spins", "spins", "/api/spins"},
+		{"/api/spins/123?foo=bar", "spins", "/api/spins"},
+		{"/api/made-up-1234", "other", "/api/other"},
+		{"/images/Persona/16/65/166599-img_profile.225x225.jpg", "images", "/images/"},
+		{"/spin-events", "other", "/spin-events"},
+		{"/events", "other", "/events"},
+		{"/trigger/spins", "other", "/trigger/spins"},
+		{"/admin/cache/entry", "other", "/admin/"},
+		{"/wp-login.php", "other", "other"},
+	}
+	for _, tt := range tests {
+		if got := Collection(tt.path); got != tt.collection {
+			t.Errorf("Collection(%q) = %q; want %q", tt.path, got, tt.collection)
+		}
+		if got := Route(tt.path); got != tt.route {
+			t.Errorf("Route(%q) = %q; want %q", tt.path, got, tt.route)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	CacheLookups.WithLabelValues("spins", "hit").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`spinitron_proxy_cache_lookups_total{collection="spins",result="hit"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wbor-fm/spinitron-proxy/cache"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
+)
+
+// upstreamResult is a fully-read upstream response that can be turned into
+// any number of independent *http.Response values. Successful responses are
+// kept as the cache entry they were stored as.
+type upstreamResult struct {
+	Entry *cache.Entry
+
+	// Used when Entry is nil.
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// response builds a new *http.Response with its own header map and body,
+// encoded according to the client's acceptEncoding.
+func (r *upstreamResult) response(acceptEncoding string) (*http.Response, error) {
+	if r.Entry != nil {
+		return serveEntry(r.Entry, "", acceptEncoding)
+	}
+
+	resp := &http.Response{
+		StatusCode:    r.StatusCode,
+		Header:        r.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	return resp, nil
+}
+
+// Stats counts upstream traffic made through a TransportWithCache.
+type Stats struct {
+	// Upstream requests actually made.
+	Fetches int64
+	// Requests that missed the cache but were answered by a fetch already in
+	// flight for the same key, instead of making their own.
+	Coalesced int64
+}
+
+// Stats returns the transport's counters so far.
+func (t *TransportWithCache) Stats() Stats {
+	return Stats{
+		Fetches:   t.fetches.Load(),
+		Coalesced: t.coalesced.Load(),
+	}
+}
+
+// fetchShared fetches key from upstream, collapsing concurrent calls for the
+// same cache key into a single request whose result is fanned out to every
+// caller. Forced refreshes only coalesce with each other, so that they never
+// return data from a fetch that started before the refresh was requested.
+// The response is encoded according to acceptEncoding.
+func (t *TransportWithCache) fetchShared(req *http.Request, key string, force bool, acceptEncoding string) (*http.Response, error) {
+	flightKey := key
+	if force {
+		flightKey = "forceRefresh:" + key
+	}
+
+	// Do runs the function in the first caller's goroutine only, so `leader`
+	// is only ever set for that caller.
+	leader := false
+	v, err, _ := t.group.Do(flightKey, func() (any, error) {
+		leader = true
+
+		// Detach from the caller's context: if the first client goes away,
+		// the others are still waiting for this result.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), fetchTimeout)
+		defer cancel()
+		upReq := req.Clone(ctx)
+		withoutConditionals(upReq)
+		// Let the transport negotiate (and transparently decode) compression
+		// with Spinitron, so the body we cache is never encoded twice.
+		upReq.Header.Del("Accept-Encoding")
+		return t.fetch(upReq, key)
+	})
+
+	if !leader {
+		t.coalesced.Add(1)
+		metrics.UpstreamCoalesced.Inc()
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.Bool("upstream.coalesced", true))
+		slog.InfoContext(req.Context(), "request.coalesced", "key", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*upstreamResult).response(acceptEncoding)
+}
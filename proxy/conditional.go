@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// conditionalHeaders are client validators. They are answered by the proxy
+// from its own cache entries and never forwarded to Spinitron, whose 304s we
+// couldn't cache.
+var conditionalHeaders = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Match",
+	"If-Unmodified-Since",
+	"If-Range",
+}
+
+// notModifiedHeaders are copied from the full response onto a 304 (RFC 9110,
+// section 15.4.5).
+var notModifiedHeaders = []string{
+	"Age",
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+	"Warning",
+}
+
+// notModified returns a 304 Not Modified in place of resp if req's validators
+// match it, and resp otherwise. Only successful GET and HEAD responses are
+// considered.
+func notModified(req *http.Request, resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusOK || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return resp
+	}
+
+	if !validatorsMatch(req.Header, resp.Header) {
+		return resp
+	}
+
+	resp.Body.Close()
+	out := &http.Response{
+		StatusCode: http.StatusNotModified,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	}
+	for _, name := range notModifiedHeaders {
+		if v := resp.Header.Values(name); len(v) > 0 {
+			out.Header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return out
+}
+
+// validatorsMatch reports whether the response described by header is what
+// the client already has. If-None-Match takes precedence over
+// If-Modified-Since, as required by RFC 9110, section 13.2.2.
+func validatorsMatch(reqHeader, header http.Header) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		return etag != "" && etagListMatches(inm, etag)
+	}
+
+	if ims := reqHeader.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !modified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// etagListMatches reports whether etag appears in the comma-separated
+// If-None-Match list, using the weak comparison If-None-Match calls for.
+func etagListMatches(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutConditionals strips client validators from an upstream request.
+func withoutConditionals(req *http.Request) {
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows the
+// given content coding, honoring q-values (a q of 0 means "not acceptable")
+// and the "*" wildcard.
+func acceptsEncoding(header, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch name {
+		case coding:
+			// An explicit entry wins over the wildcard either way.
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
+
+// encodedETag derives the entity tag of an encoded representation from the
+// tag of the unencoded one, e.g. "abc" becomes "abc-gzip". Each
+// representation needs its own strong validator.
+func encodedETag(etag, coding string) string {
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+}
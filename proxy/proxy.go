@@ -2,24 +2,54 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
 	"github.com/wbor-fm/spinitron-proxy/cache"
+	"github.com/wbor-fm/spinitron-proxy/clientkeys"
+	"github.com/wbor-fm/spinitron-proxy/logging"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
+	"github.com/wbor-fm/spinitron-proxy/tracing"
 )
 
 // Lingering questions: what is `io.NopCloser(bytes.NewReader(value)),`
 // and why do we close resp.Body before reassigning it?
 // What is reassignment?
 
-// OnSpinsUpdate is a callback that, when set, is called with a message
-// after /api/spins is updated.
-var OnSpinsUpdate func(msg string)
+// OnCollectionUpdate is a callback that, when set, is called with the name
+// and new body of a collection's first page (e.g. "spins" and the body of
+// /api/spins) whenever it is fetched from Spinitron. ctx is that of the
+// request that fetched the update, so the callback can be traced as part of
+// it.
+var OnCollectionUpdate func(ctx context.Context, collection string, body []byte)
+
+// Warning header values (RFC 7234, section 5.5) attached to stale responses.
+const (
+	warnStale            = `110 - "Response is Stale"`
+	warnRevalidateFailed = `111 - "Revalidation Failed"`
+)
+
+// fetchTimeout bounds upstream requests. They are detached from the client
+// request that started them, since other clients may be waiting on the same
+// fetch (see fetchShared) or none at all (see refreshInBackground).
+const fetchTimeout = 30 * time.Second
 
 // Custom transport that checks a local cache before making an external request.
 // (Unless the request has ?forceRefresh=1, in which case it skips the cache.)
@@ -27,11 +57,42 @@ var OnSpinsUpdate func(msg string)
 type TransportWithCache struct {
 	Transport http.RoundTripper // Underlying transport for cache misses.
 	Cache     *cache.Cache      // In-memory cache.
+
+	refreshing  map[string]bool // Keys with a background refresh in progress.
+	refreshingM sync.Mutex      // to synchronize access to refreshing
+	background  sync.WaitGroup  // Background refreshes still running.
+
+	group     singleflight.Group // Collapses concurrent fetches of one key.
+	fetches   atomic.Int64       // Upstream requests made.
+	coalesced atomic.Int64       // Requests that shared another's fetch.
 }
 
 // RoundTrip checks the cache before making a network request. It caches fresh
 // responses and broadcasts an SSE message if the request is for spins.
+// Responses to conditional requests (If-None-Match, If-Modified-Since) whose
+// validators still match are turned into 304 Not Modified.
 func (t *TransportWithCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The whole lookup, including any upstream request it makes, is one span.
+	ctx, span := tracing.Tracer().Start(req.Context(), "cache.lookup")
+	defer span.End()
+	req = req.WithContext(ctx)
+
+	resp, err := t.lookup(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return notModified(req, resp), nil
+}
+
+// lookup serves req from the cache or from upstream.
+//
+// Expired entries are still used for a grace window: within the cache's
+// StaleWhileRevalidate window they are served immediately while a single
+// background refresh runs, and within its StaleIfError window they are served
+// when the upstream request fails or returns a 5xx.
+func (t *TransportWithCache) lookup(req *http.Request) (*http.Response, error) {
 
 	// Check if the request has ?forceRefresh=1 to skip cache retrieval
 	forceRefresh := (req.URL.Query().Get("forceRefresh") == "1")
@@ -39,80 +100,262 @@ func (t *TransportWithCache) RoundTrip(req *http.Request) (*http.Response, error
 	// Generate a cache key based on the incoming HTTP request.
 	key := t.Cache.MakeCacheKey(req) // `key` is the actual cache key.
 
+	// Record how the request was answered on the cache.lookup span.
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(
+		attribute.String("cache.key", key),
+		attribute.String("cache.collection", api.GetCollectionName(key)),
+	)
+	result := func(r string) { span.SetAttributes(attribute.String("cache.result", r)) }
+
+	// Compressed entries are sent as-is to clients that accept their coding.
+	acceptEncoding := strings.Join(req.Header.Values("Accept-Encoding"), ",")
+
 	// If forceRefresh is NOT set, try retrieving from the cache as normal.
+	var entry *cache.Entry
 	if !forceRefresh {
-		if value, found := t.Cache.Get(key); found {
-			resp := &http.Response{
-				StatusCode: http.StatusOK,
-				Header:     make(http.Header),
-				Body:       io.NopCloser(bytes.NewReader(value)),
-			}
-			resp.Header.Set("Content-Type", "application/json")
-			return resp, nil // `nil` means no error occurred.
-		}
+		entry, _ = t.Cache.Get(key)
 	} else {
 		// If forceRefresh is set, log that we're skipping the cache.
-		log.Println("cache.skip", key, "(forceRefresh)")
+		slog.InfoContext(req.Context(), "cache.skip", "key", key, "reason", "forceRefresh")
+	}
+
+	if entry != nil {
+		now := time.Now()
+		if entry.Fresh(now) {
+			result("hit")
+			return serveEntry(entry, "", acceptEncoding)
+		}
+
+		// Expired, but recent enough to serve while we refresh it.
+		if entry.Staleness(now) <= t.Cache.StaleWhileRevalidate {
+			result("stale")
+			t.refreshInBackground(req, key)
+			return serveEntry(entry, warnStale, acceptEncoding)
+		}
+	}
+
+	if forceRefresh {
+		result("refresh")
+	} else {
+		result("miss")
+	}
+
+	// If forceRefresh IS set, or cache was a miss, do the real network request
+	// (or wait for an identical one that is already in flight).
+	resp, err := t.fetchShared(req, key, forceRefresh, acceptEncoding)
+
+	// If the upstream failed, fall back to the stale entry if we still may.
+	if entry != nil && entry.Staleness(time.Now()) <= t.Cache.StaleIfError {
+		if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+			if err == nil {
+				resp.Body.Close()
+			}
+			slog.WarnContext(req.Context(), "cache.stale-if-error", "key", key, "error", err)
+			result("stale-if-error")
+			return serveEntry(entry, warnRevalidateFailed, acceptEncoding)
+		}
 	}
 
-	// If forceRefresh IS set, or cache was a miss, do the real network request.
+	return resp, err
+}
+
+// fetch makes the upstream request for key and stores a successful response
+// in the cache. The body is read in full so the result can be handed to
+// several callers.
+func (t *TransportWithCache) fetch(req *http.Request, key string) (*upstreamResult, error) {
 	tick := time.Now()
+	t.fetches.Add(1)
+	collection := metrics.Collection(key)
+
+	ctx, span := tracing.Tracer().Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("cache.key", key),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
 	resp, err := t.Transport.RoundTrip(req) // Make the request, get response.
 	if err != nil {
 		// If there was an error making the request, return it immediately.
+		metrics.UpstreamResponses.WithLabelValues(collection, "error").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
-
-	// If the response status is not OK, return it directly without caching.
-	if resp.StatusCode != http.StatusOK {
-		return resp, err
-	}
+	defer resp.Body.Close()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		// If there was an error reading the response body, return immediately.
+		metrics.UpstreamResponses.WithLabelValues(collection, "error").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
-	// The response body must be closed before reassigning.
-	resp.Body.Close()
+	elapsed := time.Since(tick)
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	slog.InfoContext(req.Context(), "request.made", "key", key, "collection", api.GetCollectionName(key),
+		"status", resp.StatusCode, "duration", elapsed)
+	metrics.UpstreamDuration.WithLabelValues(collection).Observe(elapsed.Seconds())
+	metrics.UpstreamResponses.WithLabelValues(collection, strconv.Itoa(resp.StatusCode)).Inc()
 
-	// Wrap data in a new ReadCloser so the rest of the chain can read it.
-	resp.Body = io.NopCloser(bytes.NewReader(data))
-	log.Println("request.made", time.Since(tick), key)
+	// If the response status is not OK, return it directly without caching.
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamResult{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       data,
+		}, nil
+	}
 
 	// Even if forceRefresh was set, we still store the new data in the cache,
 	// so that subsequent requests without forceRefresh can use the updated
-	// data.
-	t.Cache.Set(key, data)
+	// data. Set keeps only the allowed headers, and this response is served
+	// from the same entry, so that misses and later hits look identical.
+	entry := &cache.Entry{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       data,
+	}
+	t.Cache.Set(key, entry)
+	result := &upstreamResult{Entry: entry}
 
-	// Only broadcast an SSE if the canonical "/api/spins" cache entry was updated.
+	// Only broadcast an SSE if a canonical collection entry, such as
+	// "/api/spins", was updated.
 	// The `key` variable is the actual cache key used, after processing things like 'forceRefresh'.
 	// For the trigger's internal GET "/api/spins?forceRefresh=1", the key becomes "/api/spins".
 	// For a client request to "/api/spins", the key is also "/api/spins".
-	// For a client request to "/api/spins?count=10", the key is "/api/spins?count=10", which won't match.
-	if key == "/api/spins" {
-		if OnSpinsUpdate != nil {
-			log.Printf("proxy.OnSpinsUpdate triggered for canonical key: %s", key)
-			OnSpinsUpdate("new spin data")
+	// For a client request to "/api/spins?count=10", the key is "/api/spins?count=10", which won't match,
+	// and neither will a single resource such as "/api/spins/123".
+	if name := api.GetCollectionName(key); name != "" && key == "/api/"+name {
+		if OnCollectionUpdate != nil {
+			slog.InfoContext(req.Context(), "proxy.collection-updated", "key", key, "collection", name)
+			OnCollectionUpdate(req.Context(), name, data)
 		}
 	}
 
-	return resp, err
+	return result, nil
 }
 
-// NewReverseProxy creates a reverse proxy client that forwards requests to the
-// target (Spinitron API) URL. It also sets up authentication and caching.
-func NewReverseProxy(tokenEnvVarName string, target *url.URL) *httputil.ReverseProxy {
-	// Retrieve the Spinitron API token from the environment.
-	tkn := os.Getenv(tokenEnvVarName)
-	if tkn == "" {
-		panic(tokenEnvVarName + " environment variable is empty")
+// refreshInBackground re-fetches key without blocking the caller. At most one
+// refresh per key runs at a time; further calls while it runs are no-ops.
+func (t *TransportWithCache) refreshInBackground(req *http.Request, key string) {
+	t.refreshingM.Lock()
+	if t.refreshing == nil {
+		t.refreshing = make(map[string]bool)
+	}
+	if t.refreshing[key] {
+		t.refreshingM.Unlock()
+		return
+	}
+	t.refreshing[key] = true
+	t.background.Add(1)
+	t.refreshingM.Unlock()
+
+	go func() {
+		defer func() {
+			t.refreshingM.Lock()
+			delete(t.refreshing, key)
+			t.refreshingM.Unlock()
+			t.background.Done()
+		}()
+
+		slog.InfoContext(req.Context(), "cache.revalidate", "key", key)
+		resp, err := t.fetchShared(req, key, false, "")
+		if err != nil {
+			slog.WarnContext(req.Context(), "cache.revalidate failed", "key", key, "error", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// Drain waits for background refreshes to finish, so that their results are
+// cached before shutting down, or until ctx is done. Requests made by clients
+// are waited for by http.Server.Shutdown instead.
+func (t *TransportWithCache) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serveEntry builds a response from a cached entry, with the status and
+// headers stored alongside its body plus validators (ETag, Last-Modified) and
+// a Cache-Control max-age derived from the entry's remaining TTL. A non-empty
+// warning marks the response as stale.
+//
+// A compressed entry is sent as-is if acceptEncoding (the client's
+// Accept-Encoding) allows its coding, and decompressed otherwise.
+func serveEntry(entry *cache.Entry, warning string, acceptEncoding string) (*http.Response, error) {
+	now := time.Now()
+
+	resp := &http.Response{
+		StatusCode: entry.StatusCode,
+		Header:     make(http.Header),
+	}
+	for name, values := range entry.Header {
+		resp.Header[name] = append([]string(nil), values...)
+	}
+
+	// Entries stored before status and headers were cached have neither.
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if resp.Header.Get("Content-Type") == "" {
+		resp.Header.Set("Content-Type", "application/json")
+	}
+
+	body, etag := entry.Body, entry.ETag
+	if entry.Encoding != cache.EncodingIdentity {
+		resp.Header.Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(acceptEncoding, entry.Encoding) {
+			resp.Header.Set("Content-Encoding", entry.Encoding)
+			etag = encodedETag(etag, entry.Encoding)
+		} else {
+			var err error
+			if body, err = entry.Identity(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	pubDomain := os.Getenv("INSTALLATION_BASE_URL")
-	if pubDomain == "" {
-		panic("INSTALLATION_BASE_URL environment variable is empty")
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Age", strconv.Itoa(int(entry.Age(now).Seconds())))
+	resp.Header.Set("Cache-Control", "max-age="+strconv.Itoa(int(entry.MaxAge(now).Seconds())))
+	resp.Header.Set("Last-Modified", entry.StoredAt.UTC().Format(http.TimeFormat))
+	if etag != "" {
+		resp.Header.Set("ETag", etag)
+	}
+	if warning != "" {
+		resp.Header.Set("Warning", warning)
 	}
+	return resp, nil
+}
+
+// NewReverseProxy creates a reverse proxy client that forwards requests to the
+// target (Spinitron API) URL. It authenticates with the API token `tkn`, sends
+// `pubDomain` as the Host, and serves responses from cache `c` when possible.
+func NewReverseProxy(target *url.URL, tkn string, pubDomain string, c *cache.Cache) *httputil.ReverseProxy {
 
 	// Create a single-host reverse proxy for the given target URL.
 	// A single-host reverse proxy forwards requests to a single target URL.
@@ -132,16 +375,19 @@ func NewReverseProxy(tokenEnvVarName string, target *url.URL) *httputil.ReverseP
 		req.Header.Set("Authorization", "Bearer "+tkn)
 		// Force the request to accept JSON.
 		req.Header.Set("accept", "application/json")
+		// Client keys are for this proxy, not for Spinitron.
+		req.Header.Del(clientkeys.Header)
 
 		// Set the Host header to the target host
 		req.Host = pubDomain
 		req.Header.Set("X-Forwarded-Host", pubDomain)
-	}
 
-	// Initialize in-memory cache to store responses using the cache package we
-	// defined in cache/cache.go.
-	c := &cache.Cache{}
-	c.Init()
+		// Pass our request ID on, so upstream requests can be matched with
+		// the client request that caused them.
+		if id := logging.RequestID(req.Context()); id != "" {
+			req.Header.Set(logging.RequestIDHeader, id)
+		}
+	}
 
 	// Override the proxy's default (from httputil.ReverseProxy) transport with
 	// our custom caching transport.
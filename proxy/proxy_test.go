@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/cache"
+)
+
+// fakeUpstream is an http.RoundTripper that answers with a canned response
+// and counts how often it was called.
+type fakeUpstream struct {
+	mu     sync.Mutex
+	calls  int
+	status int
+	header http.Header
+	body   string
+	err    error
+}
+
+func (f *fakeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	header := f.header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode: f.status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(f.body)),
+	}, nil
+}
+
+func (f *fakeUpstream) set(status int, body string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.body, f.err = status, body, err
+}
+
+func (f *fakeUpstream) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// newTestTransport returns a transport whose cache holds /api/spins for ttl.
+func newTestTransport(up *fakeUpstream, ttl, swr, sie time.Duration) *TransportWithCache {
+	c := &cache.Cache{
+		TTLs: cache.NewTTLPolicy(cache.TTLTable{
+			Collections: map[string]time.Duration{"spins": ttl},
+		}),
+		StaleWhileRevalidate: swr,
+		StaleIfError:         sie,
+	}
+	c.Init()
+	return &TransportWithCache{Transport: up, Cache: c}
+}
+
+// get performs a GET for path through the transport and returns the response
+// and its body.
+func get(t *testing.T, tr http.RoundTripper, path string) (*http.Response, string) {
+	t.Helper()
+	resp, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream"+path, nil))
+	if err != nil {
+		t.Fatalf("RoundTrip(%s) error: %v", path, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestRoundTripServesFromCache(t *testing.T) {
+	up := &fakeUpstream{status: http.StatusOK, body: "v1"}
+	tr := newTestTransport(up, time.Minute, 0, 0)
+
+	get(t, tr, "/api/spins")
+	resp, body := get(t, tr, "/api/spins")
+
+	if body != "v1" || up.callCount() != 1 {
+		t.Errorf("second request: body %q with %d upstream calls; want v1 with 1", body, up.callCount())
+	}
+	if resp.Header.Get("Warning") != "" {
+		t.Errorf("fresh hit has Warning %q", resp.Header.Get("Warning"))
+	}
+}
+
+// Checks that a hit carries the same status, headers and body as the miss
+// that filled the cache, and that headers outside the whitelist are dropped.
+func TestRoundTripHitMatchesMiss(t *testing.T) {
+	up := &fakeUpstream{
+		status: http.StatusOK,
+		body:   "\x89PNG",
+		header: http.Header{
+			"Content-Type":         {"image/png"},
+			"Link":                 {`</api/spins?page=2>; rel="next"`},
+			"X-Pagination-Current": {"1"},
+			"Set-Cookie":           {"session=upstream"},
+		},
+	}
+	c := &cache.Cache{TTLs: cache.NewTTLPolicy(cache.TTLTable{Default: time.Minute})}
+	c.Init()
+	tr := &TransportWithCache{Transport: up, Cache: c}
+
+	miss, missBody := get(t, tr, "/images/Persona/1.png")
+	hit, hitBody := get(t, tr, "/images/Persona/1.png")
+
+	if up.callCount() != 1 {
+		t.Fatalf("upstream calls = %d; want 1", up.callCount())
+	}
+	if hitBody != missBody || hit.StatusCode != miss.StatusCode {
+		t.Errorf("hit = %d %q; want %d %q like the miss", hit.StatusCode, hitBody, miss.StatusCode, missBody)
+	}
+	for _, name := range []string{"Content-Type", "Link", "X-Pagination-Current", "Content-Length"} {
+		if hit.Header.Get(name) == "" || hit.Header.Get(name) != miss.Header.Get(name) {
+			t.Errorf("%s: hit %q, miss %q; want equal and non-empty", name, hit.Header.Get(name), miss.Header.Get(name))
+		}
+	}
+	if hit.Header.Get("Set-Cookie") != "" || miss.Header.Get("Set-Cookie") != "" {
+		t.Error("Set-Cookie was passed through; want it dropped")
+	}
+}
+
+func TestRoundTripStaleWhileRevalidate(t *testing.T) {
+	up := &fakeUpstream{status: http.StatusOK, body: "v1"}
+	tr := newTestTransport(up, 50*time.Millisecond, time.Minute, 0)
+
+	get(t, tr, "/api/spins")
+	time.Sleep(80 * time.Millisecond)
+	up.set(http.StatusOK, "v2", nil)
+
+	// The expired entry is served immediately, marked as stale.
+	resp, body := get(t, tr, "/api/spins")
+	if body != "v1" {
+		t.Errorf("stale request body = %q; want v1", body)
+	}
+	if resp.Header.Get("Warning") == "" || resp.Header.Get("Age") == "" {
+		t.Errorf("stale response headers = %v; want Warning and Age", resp.Header)
+	}
+
+	// The background refresh eventually replaces it.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, body = get(t, tr, "/api/spins"); body == "v2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body != "v2" {
+		t.Errorf("body after refresh = %q; want v2", body)
+	}
+	if up.callCount() != 2 {
+		t.Errorf("upstream calls = %d; want 2", up.callCount())
+	}
+}
+
+func TestRoundTripStaleIfError(t *testing.T) {
+	up := &fakeUpstream{status: http.StatusOK, body: "v1"}
+	tr := newTestTransport(up, 50*time.Millisecond, 0, time.Minute)
+
+	get(t, tr, "/api/spins")
+	time.Sleep(80 * time.Millisecond)
+
+	for _, tc := range []struct {
+		status int
+		err    error
+	}{
+		{http.StatusBadGateway, nil},
+		{0, errors.New("connection refused")},
+	} {
+		up.set(tc.status, "upstream error", tc.err)
+
+		resp, body := get(t, tr, "/api/spins")
+		if body != "v1" || resp.StatusCode != http.StatusOK {
+			t.Errorf("upstream (%d, %v): got %d %q; want 200 v1", tc.status, tc.err, resp.StatusCode, body)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Warning"), "111") {
+			t.Errorf("upstream (%d, %v): Warning = %q; want 111", tc.status, tc.err, resp.Header.Get("Warning"))
+		}
+	}
+}
+
+func TestRoundTripErrorWithoutStaleEntry(t *testing.T) {
+	up := &fakeUpstream{err: errors.New("connection refused")}
+	tr := newTestTransport(up, time.Minute, time.Minute, time.Minute)
+
+	_, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream/api/spins", nil))
+	if err == nil {
+		t.Error("RoundTrip with failing upstream and empty cache returned nil error")
+	}
+}
+
+// blockingUpstream answers every request with "ok" once release is closed.
+type blockingUpstream struct {
+	fakeUpstream
+	release chan struct{}
+}
+
+func (b *blockingUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-b.release
+	return b.fakeUpstream.RoundTrip(req)
+}
+
+// countingStore is a MemoryStore that counts its hits and misses.
+type countingStore struct {
+	*cache.MemoryStore
+	hits, misses atomic.Int64
+}
+
+func (s *countingStore) Get(key string) (*cache.Entry, bool) {
+	e, ok := s.MemoryStore.Get(key)
+	if ok {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+	return e, ok
+}
+
+func TestRoundTripCoalescesConcurrentMisses(t *testing.T) {
+	up := &blockingUpstream{
+		fakeUpstream: fakeUpstream{status: http.StatusOK, body: "ok"},
+		release:      make(chan struct{}),
+	}
+	store := &countingStore{MemoryStore: cache.NewMemoryStore(100)}
+	c := &cache.Cache{Store: store, TTLs: cache.NewTTLPolicy(cache.TTLTable{Default: time.Minute})}
+	c.Init()
+	tr := &TransportWithCache{Transport: up, Cache: c}
+
+	const clients = 20
+	var wg sync.WaitGroup
+	bodies := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, body := get(t, tr, "/api/spins")
+			bodies <- body
+		}()
+	}
+
+	// Hold the fetch until every client has missed the cache, so that they
+	// all go on to join it. Whatever the timing, each client other than the
+	// one that fetched is either coalesced or answered from the cache.
+	deadline := time.Now().Add(5 * time.Second)
+	for store.misses.Load() < clients && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(up.release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != "ok" {
+			t.Errorf("client got body %q; want ok", body)
+		}
+	}
+	if up.callCount() != 1 {
+		t.Errorf("upstream calls = %d; want 1", up.callCount())
+	}
+	stats := tr.Stats()
+	if hits := store.hits.Load(); stats.Fetches != 1 || stats.Coalesced+hits != clients-1 {
+		t.Errorf("Stats() = %+v with %d cache hits; want 1 fetch and %d coalesced or hits", stats, hits, clients-1)
+	}
+}
+
+func TestRoundTripConditionalRequests(t *testing.T) {
+	up := &fakeUpstream{status: http.StatusOK, body: `{"items":[]}`}
+	tr := newTestTransport(up, time.Minute, 0, 0)
+
+	resp, _ := get(t, tr, "/api/spins")
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Fatalf("response headers = %v; want ETag and Last-Modified", resp.Header)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=59" && cc != "max-age=60" {
+		t.Errorf("Cache-Control = %q; want max-age of about 60", cc)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"matching etag", "If-None-Match", etag, http.StatusNotModified},
+		{"etag in list", "If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+		{"stale etag", "If-None-Match", `"other"`, http.StatusOK},
+		{"not modified since", "If-Modified-Since", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), http.StatusNotModified},
+		{"modified since", "If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://upstream/api/spins", nil)
+		req.Header.Set(tc.header, tc.value)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d; want %d", tc.name, resp.StatusCode, tc.want)
+		}
+		if resp.StatusCode == http.StatusNotModified && (len(body) != 0 || resp.Header.Get("ETag") != etag) {
+			t.Errorf("%s: 304 with body %q and ETag %q; want no body and ETag %s", tc.name, body, resp.Header.Get("ETag"), etag)
+		}
+	}
+
+	if up.callCount() != 1 {
+		t.Errorf("upstream calls = %d; want 1", up.callCount())
+	}
+}
+
+func TestRoundTripCompression(t *testing.T) {
+	body := strings.Repeat(`{"artist":"Stereolab","song":"French Disko"},`, 50)
+	up := &fakeUpstream{status: http.StatusOK, body: body, header: http.Header{"Content-Type": {"application/json"}}}
+
+	for _, coding := range []string{cache.EncodingGzip, cache.EncodingBrotli} {
+		c := &cache.Cache{
+			TTLs:        cache.NewTTLPolicy(cache.TTLTable{Default: time.Minute}),
+			Compression: coding,
+		}
+		c.Init()
+		tr := &TransportWithCache{Transport: up, Cache: c}
+
+		// A client accepting the stored coding gets the compressed bytes.
+		req := httptest.NewRequest(http.MethodGet, "http://upstream/api/spins", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.Header.Get("Content-Encoding") != coding {
+			t.Errorf("%s: Content-Encoding = %q; want %s", coding, resp.Header.Get("Content-Encoding"), coding)
+		}
+		if len(compressed) >= len(body) {
+			t.Errorf("%s: body is %d bytes; want fewer than %d", coding, len(compressed), len(body))
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q; want Accept-Encoding", coding, resp.Header.Get("Vary"))
+		}
+
+		// A client that doesn't gets the original body.
+		req = httptest.NewRequest(http.MethodGet, "http://upstream/api/spins", nil)
+		req.Header.Set("Accept-Encoding", coding+";q=0")
+		resp, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.Header.Get("Content-Encoding") != "" || string(plain) != body {
+			t.Errorf("%s: identity response has Content-Encoding %q and %d bytes; want none and %d",
+				coding, resp.Header.Get("Content-Encoding"), len(plain), len(body))
+		}
+	}
+}
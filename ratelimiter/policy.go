@@ -0,0 +1,247 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
+)
+
+// GroupBy decides which requests share a bucket under a policy.
+type GroupBy string
+
+const (
+	// GroupIP gives each client one bucket for everything the policy covers.
+	GroupIP GroupBy = "ip"
+	// GroupIPPath gives each client a bucket per path, so /api/shows/1 and
+	// /api/shows/2 are counted separately.
+	GroupIPPath GroupBy = "ip_path"
+	// GroupIPCollection gives each client a bucket per collection (route),
+	// shared by its listing, pages and resources: /api/shows?page=2 and
+	// /api/shows/1 count against the same bucket.
+	GroupIPCollection GroupBy = "ip_collection"
+	// GroupGlobal has every client share one bucket, capping the total load
+	// a route can put on Spinitron.
+	GroupGlobal GroupBy = "global"
+)
+
+// Valid reports whether g is one of the groupings above.
+func (g GroupBy) Valid() bool {
+	switch g {
+	case GroupIP, GroupIPPath, GroupIPCollection, GroupGlobal:
+		return true
+	}
+	return false
+}
+
+// Limiter counts requests per key against a limit. It is implemented by
+// RateLimiter, local to this process, and RedisLimiter, shared between
+// replicas.
+type Limiter interface {
+	// Take counts a request for key if it is within the limit, and
+	// reports the state of key's quota afterwards.
+	Take(key string) Result
+}
+
+// Policy is a limit applied to the requests it matches.
+type Policy struct {
+	// Name identifies the policy in logs and metrics.
+	Name string
+	// Path prefixes the policy applies to, e.g. "/api/spins" or "/images/".
+	// A prefix matches whole path segments: "/api/spins" matches
+	// "/api/spins/1" but not "/api/spinsfoo".
+	Routes []string
+	// Collections the policy applies to, e.g. "spins" for /api/spins and
+	// its resources.
+	Collections []string
+	// Client tiers the policy applies to (see Policies.Tier). Empty matches
+	// every client.
+	Tiers []string
+	// How requests are grouped into buckets. Empty means GroupIPPath.
+	GroupBy GroupBy
+	// The limit itself. Each policy has its own limiter, so its buckets are
+	// never shared with another policy's.
+	Limiter Limiter
+}
+
+// Matches reports whether the policy applies to r from a client of the given
+// tier. A policy without routes or collections applies to every path.
+func (p *Policy) Matches(r *http.Request, tier string) bool {
+	if len(p.Tiers) > 0 && !slices.Contains(p.Tiers, tier) {
+		return false
+	}
+	if len(p.Routes) == 0 && len(p.Collections) == 0 {
+		return true
+	}
+	for _, route := range p.Routes {
+		if matchRoute(route, r.URL.Path) {
+			return true
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") && slices.Contains(p.Collections, api.GetCollectionName(r.URL.Path)) {
+		return true
+	}
+	return false
+}
+
+// matchRoute reports whether path is route or below it.
+func matchRoute(route, path string) bool {
+	route = strings.TrimSuffix(route, "/")
+	return path == route || strings.HasPrefix(path, route+"/")
+}
+
+// Key returns the bucket key for r under the policy's grouping.
+func (p *Policy) Key(r *http.Request) string {
+	switch p.GroupBy {
+	case GroupIP:
+		return clientip.FromRequest(r)
+	case GroupIPCollection:
+		// metrics.Route reports unknown collections as "other", so made-up
+		// paths can't create new buckets faster than new clients can.
+		return clientip.FromRequest(r) + metrics.Route(r.URL.Path)
+	case GroupGlobal:
+		return ""
+	}
+	return clientip.FromRequest(r) + r.URL.Path
+}
+
+// Policies picks the policy for each request and enforces it.
+type Policies struct {
+	// Checked in order; the first that matches a request applies.
+	Policies []*Policy
+	// Applies to requests no policy matches. Nil lets them through.
+	Default *Policy
+	// Clients that are never limited, e.g. the station's own servers.
+	Allowlist clientip.Set
+	// Tier returns the tier of the client making r, matched against
+	// Policy.Tiers. Nil puts every client in the "" tier.
+	Tier func(r *http.Request) string
+	// Client returns a policy of the client's own, such as the rate limit
+	// of its API key, which takes precedence over Policies. Nil, or a nil
+	// result, leaves the client to Policies.
+	Client func(r *http.Request) *Policy
+}
+
+// Policy returns the policy that applies to r, or nil if r isn't limited.
+func (ps *Policies) Policy(r *http.Request) *Policy {
+	if ps.Allowlist.ContainsIP(clientip.FromRequest(r)) {
+		return nil
+	}
+	if ps.Client != nil {
+		if p := ps.Client(r); p != nil {
+			return p
+		}
+	}
+
+	var tier string
+	if ps.Tier != nil {
+		tier = ps.Tier(r)
+	}
+	for _, p := range ps.Policies {
+		if p.Matches(r, tier) {
+			return p
+		}
+	}
+	return ps.Default
+}
+
+// Middleware wraps next and enforces the policy that applies to each
+// request. Every response carries RateLimit-* headers describing the
+// client's quota; denied requests get a 429 Too Many Requests status code
+// with a JSON body, and are logged with the client IP, path and policy.
+func (ps *Policies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := ps.Policy(r)
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res := takeTraced(r, p.Limiter, p.Key(r))
+		setHeaders(w.Header(), res)
+		if !res.Allowed {
+			metrics.RateLimitRejections.WithLabelValues(metrics.Route(r.URL.Path), p.Name).Inc()
+			writeRejection(w, res, p.Name)
+
+			slog.WarnContext(r.Context(), "ratelimit.exceeded",
+				"client_ip", clientip.FromRequest(r), "path", r.URL.Path, "policy", p.Name)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seconds rounds d up to whole seconds, as used by the headers below.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// setHeaders describes the client's quota in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers of the IETF draft
+// (draft-ietf-httpapi-ratelimit-headers), and for denied requests in
+// Retry-After. Reset and Retry-After are in whole seconds, rounded up so that
+// a client waiting that long is sure to find a token.
+func setHeaders(h http.Header, res Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(1, seconds(res.RetryAfter))))
+	}
+}
+
+// rejection is the JSON body of a 429 response.
+type rejection struct {
+	Error      string `json:"error"`
+	Policy     string `json:"policy"`
+	Limit      int    `json:"limit"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+// writeRejection writes a 429 Too Many Requests response with a JSON body
+// repeating the headers, for clients that only look at the body.
+func writeRejection(w http.ResponseWriter, res Result, policy string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(rejection{
+		Error:      "too many requests",
+		Policy:     policy,
+		Limit:      res.Limit,
+		RetryAfter: max(1, seconds(res.RetryAfter)),
+	})
+}
+
+// MiddlewareFunc is Middleware for http.HandlerFunc.
+func (ps *Policies) MiddlewareFunc(next http.HandlerFunc) http.HandlerFunc {
+	return ps.Middleware(next).ServeHTTP
+}
+
+// APIKeyHeader is the request header holding a client's API key.
+const APIKeyHeader = "X-API-Key"
+
+// KeyTiers returns a Policies.Tier function that looks up the API key sent
+// in APIKeyHeader in tiers, a map from tier name to the keys in that tier.
+// Requests without a known key are in the "" tier.
+func KeyTiers(tiers map[string][]string) func(r *http.Request) string {
+	byKey := make(map[string]string)
+	for tier, keys := range tiers {
+		for _, key := range keys {
+			byKey[key] = tier
+		}
+	}
+	return func(r *http.Request) string {
+		key := r.Header.Get(APIKeyHeader)
+		if key == "" {
+			return ""
+		}
+		return byKey[key]
+	}
+}
@@ -0,0 +1,133 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+)
+
+func newTestPolicy(name string, max int, groupBy GroupBy) *Policy {
+	rl, _ := newTestLimiter(max, time.Minute, 0)
+	return &Policy{Name: name, GroupBy: groupBy, Limiter: rl}
+}
+
+// request returns a request for target from the given client IP.
+func request(target, ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = ip + ":1234"
+	return r
+}
+
+func TestPolicyMatches(t *testing.T) {
+	p := &Policy{Routes: []string{"/images/", "/api/spins"}, Collections: []string{"shows", "metadata"}}
+	tests := map[string]bool{
+		"/images/Persona/1.jpg": true,
+		"/api/spins":            true,
+		"/api/spins/1":          true,
+		"/api/spinsfoo":         false,
+		"/api/shows/1?x=1":      true,
+		"/api/playlists":        false,
+		"/api/metadata":         true,
+		"/spin-events":          false,
+	}
+	for target, want := range tests {
+		if got := p.Matches(request(target, "192.0.2.1"), ""); got != want {
+			t.Errorf("Matches(%s) = %v; want %v", target, got, want)
+		}
+	}
+
+	p.Tiers = []string{"partner"}
+	if p.Matches(request("/api/spins", "192.0.2.1"), "") {
+		t.Error("policy for partner tier matched a client without a tier")
+	}
+	if !p.Matches(request("/api/spins", "192.0.2.1"), "partner") {
+		t.Error("policy for partner tier didn't match a partner")
+	}
+}
+
+func TestPolicyKey(t *testing.T) {
+	a1 := request("/api/shows/1", "192.0.2.1")
+	a2 := request("/api/shows?page=2", "192.0.2.1")
+	b := request("/api/shows/1", "192.0.2.2")
+
+	tests := []struct {
+		groupBy                GroupBy
+		sameResource, sameUser bool
+	}{
+		// sameResource: a1 and a2 share a bucket. sameUser: a1 and b do.
+		{GroupIPPath, false, false},
+		{GroupIPCollection, true, false},
+		{GroupIP, true, false},
+		{GroupGlobal, true, true},
+	}
+	for _, tt := range tests {
+		p := &Policy{GroupBy: tt.groupBy}
+		if got := p.Key(a1) == p.Key(a2); got != tt.sameResource {
+			t.Errorf("%s: same bucket for /api/shows/1 and /api/shows = %v; want %v", tt.groupBy, got, tt.sameResource)
+		}
+		if got := p.Key(a1) == p.Key(b); got != tt.sameUser {
+			t.Errorf("%s: same bucket for two clients = %v; want %v", tt.groupBy, got, tt.sameUser)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	allowlist, err := clientip.ParseSet([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spins := newTestPolicy("spins", 1, GroupIPCollection)
+	spins.Collections = []string{"spins"}
+	partners := newTestPolicy("partners", 100, GroupIP)
+	partners.Tiers = []string{"partner"}
+
+	ps := &Policies{
+		Policies:  []*Policy{partners, spins},
+		Default:   newTestPolicy("default", 2, GroupIPPath),
+		Allowlist: allowlist,
+		Tier:      KeyTiers(map[string][]string{"partner": {"secret"}}),
+	}
+	h := ps.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// codes makes n requests and returns their status codes.
+	codes := func(n int, newRequest func() *http.Request) []int {
+		out := make([]int, n)
+		for i := range out {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, newRequest())
+			out[i] = rec.Code
+		}
+		return out
+	}
+	last := func(codes []int) int { return codes[len(codes)-1] }
+
+	// The spins policy allows one request, shared by every spins path.
+	if got := codes(2, func() *http.Request { return request("/api/spins/1", "192.0.2.1") }); last(got) != http.StatusTooManyRequests {
+		t.Errorf("spins policy: status codes = %v; want the second to be 429", got)
+	}
+	if got := codes(1, func() *http.Request { return request("/api/spins", "192.0.2.1") }); got[0] != http.StatusTooManyRequests {
+		t.Errorf("spins policy: /api/spins after /api/spins/1 = %d; want 429", got[0])
+	}
+
+	// Everything else falls back to the default policy.
+	if got := codes(3, func() *http.Request { return request("/api/shows", "192.0.2.1") }); last(got) != http.StatusTooManyRequests {
+		t.Errorf("default policy: status codes = %v; want the third to be 429", got)
+	}
+
+	// Partners are matched first, whatever the collection.
+	if got := codes(10, func() *http.Request {
+		r := request("/api/spins", "192.0.2.1")
+		r.Header.Set(APIKeyHeader, "secret")
+		return r
+	}); last(got) != http.StatusOK {
+		t.Errorf("partner tier: status codes = %v; want all 200", got)
+	}
+
+	// Allowlisted clients are never limited.
+	if got := codes(10, func() *http.Request { return request("/api/spins", "10.1.2.3") }); last(got) != http.StatusOK {
+		t.Errorf("allowlisted client: status codes = %v; want all 200", got)
+	}
+}
@@ -1,118 +1,189 @@
 package ratelimiter
 
 import (
-	"log"
-	"net"
 	"net/http"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/tracing"
 )
 
+// RateLimiter limits how often each client may call each path, using a token
+// bucket per key: a bucket holds up to Burst tokens, refills at MaxRequests
+// per Duration, and every allowed request takes one token. A client that has
+// been quiet can therefore make Burst requests at once, and after that
+// MaxRequests per Duration on average.
+//
+// Buckets are plain numbers updated when a request arrives, so no goroutines
+// or timers are needed. Buckets that have refilled completely are
+// indistinguishable from new ones and are dropped from time to time, which
+// keeps memory bounded by the number of recently active clients.
 type RateLimiter struct {
 	// The maximum number of requests allowed in the given duration.
 	MaxRequests int
 	// The duration in which the maximum number of requests is allowed.
 	Duration time.Duration
-	// The map to store the number of requests made by an IP address.
-	VisitorMap map[string]int
-	// The mutex to synchronize access to the VisitorMap.
-	VisitorMapMux sync.Mutex
+	// The number of requests that can be made at once. Zero means
+	// MaxRequests.
+	Burst int
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mu        sync.Mutex // to synchronize access to buckets and lastSweep
+
+	// now returns the current time; replaced in tests.
+	now func() time.Time
+}
+
+// bucket is the state of one key: how many tokens it had at time last.
+type bucket struct {
+	tokens float64
+	last   time.Time
 }
 
 // NewRateLimiter creates a new RateLimiter with the given maximum number of
-// requests and duration.
+// requests and duration. Burst defaults to maxRequests and may be changed
+// before the limiter is used.
 func NewRateLimiter(maxRequests int, duration time.Duration) *RateLimiter {
 	return &RateLimiter{
 		MaxRequests: maxRequests,
 		Duration:    duration,
-		VisitorMap:  make(map[string]int),
+		buckets:     make(map[string]*bucket),
+		now:         time.Now,
 	}
 }
 
+// burst returns the bucket capacity.
+func (rl *RateLimiter) burst() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return float64(rl.MaxRequests)
+}
+
+// rate returns how many tokens are added per second.
+func (rl *RateLimiter) rate() float64 {
+	return float64(rl.MaxRequests) / rl.Duration.Seconds()
+}
+
+// Result describes a client's bucket after a request.
+type Result struct {
+	// Whether the request was allowed (and took a token).
+	Allowed bool
+	// The number of requests that can be made at once when the bucket is
+	// full.
+	Limit int
+	// The number of requests that can be made right now.
+	Remaining int
+	// How long until the bucket is full again.
+	Reset time.Duration
+	// For a denied request, how long until the next one would be allowed.
+	RetryAfter time.Duration
+}
+
 // Allow checks if the given IP address is allowed to make a request based on
 // the rate limiting rules (that is, the maximum number of requests allowed in
-// the given duration under a given IP and path).
+// the given duration under a given IP and path), and takes a token if so.
 func (rl *RateLimiter) Allow(r *http.Request) bool {
-	rl.VisitorMapMux.Lock()
-	defer rl.VisitorMapMux.Unlock()
+	return rl.allowKey(rl.MakeRequestKey(r))
+}
 
-	// Generate the request key based on the IP address and the request path.
-	key := rl.MakeRequestKey(r)
+func (rl *RateLimiter) allowKey(key string) bool {
+	return rl.Take(key).Allowed
+}
 
-	// Get the current count of requests made by the IP address.
-	count, ok := rl.VisitorMap[key]
+// Take takes a token from key's bucket if it has one, and reports the state
+// of the bucket afterwards.
+func (rl *RateLimiter) Take(key string) Result {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
 	if !ok {
-		// If the IP address is not in the map, initialize it with 1 request.
-		rl.VisitorMap[key] = 1
-		return true
+		// A new key starts with a full bucket.
+		b = &bucket{tokens: rl.burst(), last: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens = min(rl.burst(), b.tokens+now.Sub(b.last).Seconds()*rl.rate())
+		b.last = now
 	}
 
-	// If the count exceeds the maximum number of requests, return false.
-	if count >= rl.MaxRequests {
-		return false
+	res := Result{Allowed: b.tokens >= 1, Limit: int(rl.burst())}
+	if res.Allowed {
+		b.tokens--
+	} else {
+		res.RetryAfter = rl.refillTime(1 - b.tokens)
 	}
+	res.Remaining = int(b.tokens)
+	res.Reset = rl.refillTime(rl.burst() - b.tokens)
+	return res
+}
 
-	// Increment the count of requests made by the IP address.
-	rl.VisitorMap[key]++
+// refillTime returns how long it takes to add the given number of tokens to
+// a bucket.
+func (rl *RateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.rate() * float64(time.Second))
+}
 
-	// Launch a goroutine to decrement the count after the duration has passed.
-	go func() {
-		time.Sleep(rl.Duration)
-		rl.Subtract(key)
-	}()
+// sweep drops the buckets that have refilled completely, at most once per
+// Duration. It must be called with mu held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rl.Duration {
+		return
+	}
+	rl.lastSweep = now
 
-	return true
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate() >= rl.burst() {
+			delete(rl.buckets, key)
+		}
+	}
 }
 
-// The Subtract function is used to decrement the count of requests made by an
-// IP address, normally called after the request has been processed. It runs
-// in a separate goroutine to avoid blocking the request processing.
-func (rl *RateLimiter) Subtract(key string) {
-	rl.VisitorMapMux.Lock()
-	defer rl.VisitorMapMux.Unlock()
-
-	// Decrement the count of requests made under the given key (IP + path).
-	rl.VisitorMap[key]--
+// Len returns the number of keys currently tracked.
+func (rl *RateLimiter) Len() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.buckets)
 }
 
-// Generates the request key based on the IP address and the request path.
+// Generates the request key based on the client's IP address and the request
+// path. Behind trusted proxies, the IP is the one they forwarded (see the
+// clientip package).
 func (rl *RateLimiter) MakeRequestKey(r *http.Request) string {
-	// Strip the port number from the IP address.
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip + r.URL.Path
+	return clientip.FromRequest(r) + r.URL.Path
+}
+
+// takeTraced calls l.Take inside a span, so traces show the time spent
+// waiting on the limiter (and on Redis, if shared).
+func takeTraced(r *http.Request, l Limiter, key string) Result {
+	_, span := tracing.Tracer().Start(r.Context(), "ratelimit.allow")
+	defer span.End()
+
+	res := l.Take(key)
+	span.SetAttributes(
+		attribute.Bool("ratelimit.allowed", res.Allowed),
+		attribute.Int("ratelimit.remaining", res.Remaining),
+	)
+	return res
 }
 
-// The middleware function that wraps the handler and enforces rate limiting.
-// If the request is denied, it returns a 429 Too Many Requests status code.
-// Additionally, it logs the IP address and path of the request that was denied.
+// The middleware function that wraps the handler and enforces rate limiting
+// per IP address and path. It is the same as a Policies with rl as its only
+// policy; see Policies.Middleware.
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !rl.Allow(r) {
-			// Write how much time the client has to wait before making another request.
-			http.Header.Add(w.Header(), "Retry-After", rl.Duration.String())
-			// Return a 429 Too Many Requests status code.
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-
-			log.Printf("Rate limit exceeded by %s (%s)\n", r.RemoteAddr, r.URL.Path)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+	ps := &Policies{Default: &Policy{Name: "default", GroupBy: GroupIPPath, Limiter: rl}}
+	return ps.Middleware(next)
 }
 
 // This middleware function is similar to the previous one, but it's meant
 // for use with the http.HandlerFunc type instead of http.Handler.
-// It enforces rate limiting and returns a 429 Too Many Requests status code,
-// along with logging the IP address and path of the request that was denied.
 func (rl *RateLimiter) MiddlewareFunc(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !rl.Allow(r) {
-			http.Header.Add(w.Header(), "Retry-After", rl.Duration.String())
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-
-			log.Printf("Rate limit exceeded for %s on %s\n", r.RemoteAddr, r.URL.Path)
-			return
-		}
-		next(w, r)
-	}
+	return rl.Middleware(next).ServeHTTP
 }
@@ -0,0 +1,151 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for the limiter.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(max int, window time.Duration, burst int) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	rl := NewRateLimiter(max, window)
+	rl.Burst = burst
+	rl.now = clock.now
+	return rl, clock
+}
+
+// allowN calls allowKey n times and returns how many were allowed.
+func allowN(rl *RateLimiter, key string, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if rl.allowKey(key) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestTokenBucket(t *testing.T) {
+	rl, clock := newTestLimiter(60, time.Minute, 0)
+
+	// A new client gets the full bucket at once, including the very first
+	// request, and nothing more.
+	if got := allowN(rl, "a", 100); got != 60 {
+		t.Fatalf("allowed %d of a burst of 100; want 60", got)
+	}
+
+	// Tokens come back at 60/min, i.e. one per second.
+	clock.advance(5 * time.Second)
+	if got := allowN(rl, "a", 10); got != 5 {
+		t.Errorf("allowed %d after 5s; want 5", got)
+	}
+
+	// Other keys have their own bucket.
+	if !rl.allowKey("b") {
+		t.Error("key b was limited by key a's requests")
+	}
+}
+
+func TestBurst(t *testing.T) {
+	rl, clock := newTestLimiter(60, time.Minute, 5)
+
+	if got := allowN(rl, "a", 10); got != 5 {
+		t.Fatalf("allowed %d with a burst of 5; want 5", got)
+	}
+
+	// The bucket never holds more than Burst tokens, however long it waits.
+	clock.advance(time.Hour)
+	if got := allowN(rl, "a", 10); got != 5 {
+		t.Errorf("allowed %d after an hour; want 5", got)
+	}
+}
+
+func TestIdleKeysAreDropped(t *testing.T) {
+	rl, clock := newTestLimiter(60, time.Minute, 0)
+
+	allowN(rl, "a", 60)
+	clock.advance(50 * time.Second)
+	allowN(rl, "b", 30)
+	if rl.Len() != 2 {
+		t.Fatalf("Len() = %d; want 2", rl.Len())
+	}
+
+	// Keys are swept once per window. By then a has refilled completely,
+	// but b hasn't.
+	clock.advance(10 * time.Second)
+	rl.allowKey("c")
+	if rl.Len() != 2 {
+		t.Errorf("Len() = %d; want 2 (b and c)", rl.Len())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	rl, _ := newTestLimiter(2, time.Minute, 0)
+	h := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := make([]int, 3)
+	for i := range codes {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/spins", nil))
+		codes[i] = rec.Code
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("status codes = %v; want [200 200 429]", codes)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	rl, clock := newTestLimiter(2, time.Minute, 0)
+	h := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// A token comes back every 30s.
+	tests := []struct {
+		code                    int
+		remaining, reset, retry string
+	}{
+		{200, "1", "30", ""},
+		{200, "0", "60", ""},
+		{429, "0", "60", "30"},
+	}
+	var last *httptest.ResponseRecorder
+	for i, tt := range tests {
+		last = httptest.NewRecorder()
+		h.ServeHTTP(last, httptest.NewRequest("GET", "/api/spins", nil))
+
+		got := last.Header()
+		if last.Code != tt.code || got.Get("RateLimit-Limit") != "2" ||
+			got.Get("RateLimit-Remaining") != tt.remaining || got.Get("RateLimit-Reset") != tt.reset ||
+			got.Get("Retry-After") != tt.retry {
+			t.Errorf("request %d: %d with Limit=%s Remaining=%s Reset=%s Retry-After=%q; want %d with 2, %s, %s, %q",
+				i, last.Code, got.Get("RateLimit-Limit"), got.Get("RateLimit-Remaining"),
+				got.Get("RateLimit-Reset"), got.Get("Retry-After"), tt.code, tt.remaining, tt.reset, tt.retry)
+		}
+	}
+
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.NewDecoder(last.Body).Decode(&body); err != nil {
+		t.Fatalf("429 body is not JSON: %v", err)
+	}
+	if body.Error == "" || body.RetryAfter != 30 {
+		t.Errorf("429 body = %+v; want an error and retry_after 30", body)
+	}
+
+	// Part way through, Retry-After counts down to the next token.
+	clock.advance(20 * time.Second)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/spins", nil))
+	if got := rec.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After after 20s = %q; want 10", got)
+	}
+}
@@ -0,0 +1,165 @@
+package ratelimiter
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout bounds each Redis call. Every limited request waits on
+	// one, so it is kept well below what a client would notice.
+	redisTimeout = 500 * time.Millisecond
+	// redisRetryInterval is how long the limiter sticks to local limiting
+	// after Redis fails, instead of making every request wait for a timeout.
+	redisRetryInterval = 5 * time.Second
+)
+
+// slidingWindow counts a request against KEYS[1], the counter of the current
+// window, unless that would take the estimated count over the limit.
+//
+// The estimate is the current window's count plus the previous window's
+// (KEYS[2]) weighted by how much of the sliding window still overlaps it,
+// ARGV[2]. ARGV[1] is the limit and ARGV[3] how long counters are kept, in
+// milliseconds. It returns whether the request was allowed and the two
+// counts, which the caller turns into headers.
+var slidingWindow = redis.NewScript(`
+local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+local prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+if prev * tonumber(ARGV[2]) + cur + 1 > tonumber(ARGV[1]) then
+	return {0, cur, prev}
+end
+cur = redis.call('INCR', KEYS[1])
+if cur == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return {1, cur, prev}
+`)
+
+// RedisLimiter is a Limiter whose counts are kept in Redis, so that every
+// proxy replica pointing at the same server and prefix enforces one shared
+// limit instead of each allowing the full amount.
+//
+// It uses a sliding window counter: requests are counted per fixed window of
+// length Duration, and a request is allowed if the current window's count
+// plus the previous window's, scaled by how much of it falls within the last
+// Duration, stays within MaxRequests. The check and the increment happen in
+// one script, so concurrent requests on different replicas can't both take
+// the last slot. Window boundaries come from each replica's clock, which
+// should be kept in sync (e.g. with NTP).
+//
+// If Redis can't be reached, requests are limited by Fallback alone until it
+// is back, so an outage costs accuracy rather than availability.
+type RedisLimiter struct {
+	// The maximum number of requests allowed in the given duration.
+	MaxRequests int
+	// The duration in which the maximum number of requests is allowed.
+	Duration time.Duration
+	// Used while Redis is unavailable.
+	Fallback Limiter
+
+	client *redis.Client
+	prefix string
+
+	// Until when Redis is skipped, as Unix nanoseconds, after it failed.
+	downUntil atomic.Int64
+
+	// now returns the current time; replaced in tests.
+	now func() time.Time
+}
+
+// NewRedisLimiter creates a RedisLimiter with fallback's limit, storing
+// counters in client under keys starting with prefix. Limiters enforcing
+// different policies must use different prefixes.
+func NewRedisLimiter(client *redis.Client, prefix string, fallback *RateLimiter) *RedisLimiter {
+	return &RedisLimiter{
+		MaxRequests: fallback.MaxRequests,
+		Duration:    fallback.Duration,
+		Fallback:    fallback,
+		client:      client,
+		prefix:      prefix,
+		now:         time.Now,
+	}
+}
+
+// counterKey returns the Redis key counting requests for key in the given
+// window. The hash tag keeps both windows of a key on one Redis Cluster node,
+// as scripts require. Cluster ignores an empty tag, so the empty key of
+// GroupGlobal is tagged "global" instead.
+func (rl *RedisLimiter) counterKey(key string, window int64) string {
+	tag := key
+	if tag == "" {
+		tag = "global"
+	}
+	return rl.prefix + "{" + tag + "}:" + strconv.FormatInt(window, 10)
+}
+
+// Take counts a request for key in Redis if it is within the limit, falling
+// back to the local limiter if Redis fails.
+func (rl *RedisLimiter) Take(key string) Result {
+	now := rl.now()
+	if now.UnixNano() < rl.downUntil.Load() {
+		return rl.Fallback.Take(key)
+	}
+
+	window := now.UnixNano() / int64(rl.Duration)
+	elapsed := time.Duration(now.UnixNano() - window*int64(rl.Duration))
+	weight := 1 - float64(elapsed)/float64(rl.Duration)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys := []string{rl.counterKey(key, window), rl.counterKey(key, window-1)}
+	// Counters are needed for this window and the next, as its previous one.
+	ttl := 2 * rl.Duration.Milliseconds()
+	reply, err := slidingWindow.Run(ctx, rl.client, keys, rl.MaxRequests, weight, ttl).Int64Slice()
+	if err != nil || len(reply) != 3 {
+		if rl.downUntil.Swap(now.Add(redisRetryInterval).UnixNano()) < now.UnixNano() {
+			slog.Warn("ratelimit.redis.unavailable", "error", err, "retry", redisRetryInterval)
+		}
+		return rl.Fallback.Take(key)
+	}
+
+	return rl.result(reply[0] == 1, reply[1], reply[2], elapsed, weight)
+}
+
+// result describes the window after a request, given the counts of the
+// current and previous windows.
+func (rl *RedisLimiter) result(allowed bool, cur, prev int64, elapsed time.Duration, weight float64) Result {
+	limit := float64(rl.MaxRequests)
+	count := float64(prev)*weight + float64(cur)
+	res := Result{
+		Allowed:   allowed,
+		Limit:     rl.MaxRequests,
+		Remaining: max(0, int(math.Floor(limit-count))),
+	}
+
+	// The window is clear once every counted request has slid out of it.
+	left := rl.Duration - elapsed
+	switch {
+	case cur > 0:
+		res.Reset = left + rl.Duration
+	case prev > 0:
+		res.Reset = left
+	}
+
+	if !allowed {
+		// Find when the estimate drops low enough for one more request.
+		// Within this window, only the previous window's share shrinks.
+		// Failing that, wait for the next one, where this window's count
+		// shrinks in turn.
+		if float64(cur)+1 <= limit && prev > 0 {
+			need := 1 - (limit-1-float64(cur))/float64(prev)
+			res.RetryAfter = time.Duration(need*float64(rl.Duration)) - elapsed
+		} else {
+			need := 1 - (limit-1)/float64(cur)
+			res.RetryAfter = left + time.Duration(need*float64(rl.Duration))
+		}
+	}
+	return res
+}
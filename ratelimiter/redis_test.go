@@ -0,0 +1,130 @@
+package ratelimiter
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newReplica returns a RedisLimiter backed by the Redis server at addr, as a
+// proxy replica would create it, running on clock.
+func newReplica(addr string, clock *fakeClock) *RedisLimiter {
+	fallback := NewRateLimiter(10, time.Minute)
+	fallback.now = clock.now
+	rl := NewRedisLimiter(redis.NewClient(&redis.Options{Addr: addr}), "test:ratelimit:", fallback)
+	rl.now = clock.now
+	return rl
+}
+
+// takeN calls Take n times and returns how many were allowed.
+func takeN(l Limiter, key string, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if l.Take(key).Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRedisLimiterIsShared(t *testing.T) {
+	srv := miniredis.RunT(t)
+	clock := &fakeClock{t: time.Unix(1_700_000_020, 0)} // 40s into a window
+	a := newReplica(srv.Addr(), clock)
+	b := newReplica(srv.Addr(), clock)
+
+	// The limit of 10 holds across both replicas together.
+	if got := takeN(a, "client", 6) + takeN(b, "client", 6); got != 10 {
+		t.Fatalf("allowed %d across two replicas; want 10", got)
+	}
+
+	res := b.Take("client")
+	if res.Allowed || res.Remaining != 0 || res.Limit != 10 {
+		t.Errorf("Take() over the limit = %+v; want denied with 0 of 10 remaining", res)
+	}
+	// With a full current window, the next request is allowed once that
+	// window's weight has dropped to 9/10 of it, 6s into the next window.
+	if got := seconds(res.RetryAfter); got != 26 {
+		t.Errorf("RetryAfter = %s; want 26s", res.RetryAfter)
+	}
+
+	// Other keys have their own counters.
+	if !a.Take("other").Allowed {
+		t.Error("key other was limited by key client's requests")
+	}
+}
+
+func TestRedisLimiterGlobalKey(t *testing.T) {
+	srv := miniredis.RunT(t)
+	clock := &fakeClock{t: time.Unix(1_700_000_020, 0)}
+	a := newReplica(srv.Addr(), clock)
+	b := newReplica(srv.Addr(), clock)
+
+	// GroupGlobal counts every request under the empty key, which is shared
+	// like any other.
+	if got := takeN(a, "", 6) + takeN(b, "", 6); got != 10 {
+		t.Fatalf("allowed %d across two replicas; want 10", got)
+	}
+
+	// Both windows' counters carry the same non-empty hash tag, so Redis
+	// Cluster puts them in one slot.
+	for _, window := range []int64{1, 2} {
+		if key := a.counterKey("", window); !strings.HasPrefix(key, "test:ratelimit:{global}:") {
+			t.Errorf("counterKey(\"\", %d) = %q; want a {global} hash tag", window, key)
+		}
+	}
+	for _, key := range srv.Keys() {
+		if strings.Contains(key, "{}") {
+			t.Errorf("Redis key %q has an empty hash tag", key)
+		}
+	}
+}
+
+func TestRedisLimiterSlidingWindow(t *testing.T) {
+	srv := miniredis.RunT(t)
+	clock := &fakeClock{t: time.Unix(1_700_000_020, 0)}
+	rl := newReplica(srv.Addr(), clock)
+
+	takeN(rl, "client", 10)
+
+	// Halfway through the next window, half of the previous window's
+	// requests still count.
+	clock.advance(50 * time.Second)
+	if got := takeN(rl, "client", 10); got != 5 {
+		t.Errorf("allowed %d halfway through the next window; want 5", got)
+	}
+
+	// Two windows later, nothing counts any more.
+	clock.advance(2 * time.Minute)
+	if got := takeN(rl, "client", 20); got != 10 {
+		t.Errorf("allowed %d two windows later; want 10", got)
+	}
+}
+
+func TestRedisLimiterFallsBack(t *testing.T) {
+	srv := miniredis.RunT(t)
+	clock := &fakeClock{t: time.Unix(1_700_000_020, 0)}
+	rl := newReplica(srv.Addr(), clock)
+	takeN(rl, "client", 4)
+
+	// With Redis gone, the local limiter takes over (knowing nothing of the
+	// requests counted in Redis).
+	srv.Close()
+	if got := takeN(rl, "client", 20); got != 10 {
+		t.Errorf("allowed %d without Redis; want the fallback's 10", got)
+	}
+
+	// Once Redis is back, it is used again after the retry interval.
+	if err := srv.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(redisRetryInterval)
+	rl.Take("later")
+	if !slices.ContainsFunc(srv.Keys(), func(k string) bool { return strings.Contains(k, "{later}") }) {
+		t.Errorf("no counter for key later in Redis after the retry interval; keys: %v", srv.Keys())
+	}
+}
@@ -1,77 +1,187 @@
 package main
 
 import (
-	"log"
-	"net/http"
+	"context"
+	"encoding/json"
+	"log/slog"
 	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wbor-fm/spinitron-proxy/api"
+	"github.com/wbor-fm/spinitron-proxy/sse"
+	"github.com/wbor-fm/spinitron-proxy/tracing"
 )
 
 var (
-	sseClients  []chan string
-	sseClientsM sync.Mutex // to synchronize access to sseClients
+	// eventHub is the hub behind /events and /spin-events. main replaces it
+	// with one built from the config.
+	eventHub = sse.NewHub(100)
+
+	// lastSpinID is the ID of the newest spin broadcast so far.
+	lastSpinID  int64
+	lastSpinIDM sync.Mutex // held while spins are picked out and published
+
+	// The playlist and show broadcast last, i.e. the ones on air.
+	currentPlaylist, currentShow onAir
 )
 
-// spinEventsHandler is an HTTP handler that streams server-sent events (SSE) to
-// clients. It creates a channel for each client to receive messages and adds
-// the channel to the sseClients array. It then sends messages to the client
-// when they are available.
-func spinEventsHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if the client supports server-sent events via the http.Flusher
-	// interface. If it doesn't, return an error.
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+// spinEvent is the data of a "spin" event.
+type spinEvent struct {
+	Type string `json:"type"`
+	// The spins that are new since the previous event, oldest first.
+	Spins []api.Spin `json:"spins"`
+}
+
+// playlistEvent is the data of a "playlist" event.
+type playlistEvent struct {
+	Type     string       `json:"type"`
+	Playlist api.Playlist `json:"playlist"`
+}
+
+// showEvent is the data of a "show" event.
+type showEvent struct {
+	Type string   `json:"type"`
+	Show api.Show `json:"show"`
+}
+
+// onAir remembers the ID of the playlist or show currently on air.
+type onAir struct {
+	mu sync.Mutex // to synchronize access to id
+	id int64
+}
+
+// changed records id as on air, and reports whether it wasn't already.
+func (o *onAir) changed(id int64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if id == o.id {
+		return false
+	}
+	o.id = id
+	return true
+}
+
+// BroadcastUpdate is called whenever the first page of a collection is
+// fetched from Spinitron, and sends the SSE event for it, if any: "spin"
+// for new spins, "playlist" when a new playlist starts and "show" when the
+// next show comes up.
+func BroadcastUpdate(ctx context.Context, collection string, body []byte) {
+	switch collection {
+	case "spins":
+		BroadcastSpinMessage(ctx, body)
+	case "playlists":
+		broadcastPlaylist(ctx, body)
+	case "shows":
+		broadcastShow(ctx, body)
+	}
+}
+
+// publish sends an event of type typ with data v, as JSON, to the SSE
+// clients subscribed to typ.
+func publish(ctx context.Context, typ string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(ctx, "sse.broadcast failed", "type", typ, "error", err)
+		return
+	}
+	e := eventHub.Publish(ctx, typ, data)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("sse.event_id", int64(e.ID)))
+}
+
+// broadcastPlaylist sends a "playlist" event if the newest playlist in body,
+// a /api/playlists response, differs from the one sent last, e.g.
+//
+//	event: playlist
+//	data: {"type":"playlist","playlist":{"id":678,"show_id":90,"title":"...",...}}
+func broadcastPlaylist(ctx context.Context, body []byte) {
+	ctx, span := tracing.Tracer().Start(ctx, "sse.broadcast")
+	defer span.End()
+
+	playlists, err := api.ParsePlaylists(body)
+	if err != nil {
+		slog.WarnContext(ctx, "sse.broadcast unparseable playlists", "error", err)
+		return
+	}
+	if len(playlists) == 0 || !currentPlaylist.changed(playlists[0].ID) {
 		return
 	}
+	publish(ctx, "playlist", playlistEvent{Type: "playlist", Playlist: playlists[0]})
+}
+
+// broadcastShow sends a "show" event if the first show in body, a
+// /api/shows response, differs from the one sent last, e.g.
+//
+//	event: show
+//	data: {"type":"show","show":{"id":90,"title":"...","start":"...",...}}
+func broadcastShow(ctx context.Context, body []byte) {
+	ctx, span := tracing.Tracer().Start(ctx, "sse.broadcast")
+	defer span.End()
 
-	// Create a channel for this client to receive messages
-	msgChan := make(chan string, 1)
-
-	// Lock, modify slice, unlock
-	sseClientsM.Lock()
-	sseClients = append(sseClients, msgChan)
-	log.Println("sse.connect", len(sseClients))
-	sseClientsM.Unlock()
-
-	// Clean up when the client disconnects: remove the channel from the array
-	// and close the channel.
-	defer func() {
-		sseClientsM.Lock()
-		defer sseClientsM.Unlock()
-		for i, c := range sseClients {
-			if c == msgChan {
-				// Slice the client out of the array
-				sseClients = append(sseClients[:i], sseClients[i+1:]...)
-				log.Println("sse.disconnect", len(sseClients))
-				break
-			}
-		}
-		close(msgChan)
-	}()
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	for {
-		select {
-		case <-r.Context().Done():
-			// Client closed connection
-			return
-		case msg := <-msgChan:
-			// Send SSE message
-			_, _ = w.Write([]byte(msg + "\n\n"))
-			flusher.Flush()
-		}
+	shows, err := api.ParseShows(body)
+	if err != nil {
+		slog.WarnContext(ctx, "sse.broadcast unparseable shows", "error", err)
+		return
+	}
+	if len(shows) == 0 || !currentShow.changed(shows[0].ID) {
+		return
 	}
+	publish(ctx, "show", showEvent{Type: "show", Show: shows[0]})
 }
 
-// Send `msg` to all SSE clients
-func BroadcastSpinMessage(msg string) {
-	sseClientsM.Lock()
-	defer sseClientsM.Unlock()
-	log.Println("sse.broadcast", len(sseClients))
-	for _, c := range sseClients {
-		c <- "data: " + msg
+// newSpins returns the spins in body, a /api/spins response, that haven't
+// been broadcast yet, oldest first, and remembers them as broadcast. Before
+// the first broadcast only the newest spin counts as new, so that a restart
+// doesn't send a whole page of old spins. It must be called with lastSpinIDM
+// held.
+func newSpins(body []byte) ([]api.Spin, error) {
+	spins, err := api.ParseSpins(body)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := api.NewerSpins(spins, lastSpinID)
+	if lastSpinID == 0 && len(fresh) > 1 {
+		fresh = fresh[len(fresh)-1:]
 	}
+	if len(fresh) > 0 {
+		lastSpinID = fresh[len(fresh)-1].ID
+	}
+	return fresh, nil
+}
+
+// BroadcastSpinMessage sends the spins in body, a fresh /api/spins response,
+// that are new since the last broadcast to the SSE clients subscribed to
+// spins, as an event like:
+//
+//	id: 1714572180000001
+//	event: spin
+//	data: {"type":"spin","spins":[{"id":12345,"artist":"...",...}]}
+//
+// The id is the hub's event ID, which clients send back as Last-Event-ID to
+// be sent the events they missed. Nothing is sent if no spin is new, e.g.
+// when /api/spins was refreshed only because its cache entry expired.
+//
+// Refreshes may run at once (e.g. /trigger/spins and an expired entry), so
+// spins are picked out and published under one lock: each spin is sent once,
+// and in the order of the event IDs.
+func BroadcastSpinMessage(ctx context.Context, body []byte) {
+	ctx, span := tracing.Tracer().Start(ctx, "sse.broadcast")
+	defer span.End()
+
+	lastSpinIDM.Lock()
+	defer lastSpinIDM.Unlock()
+
+	spins, err := newSpins(body)
+	if err != nil {
+		slog.WarnContext(ctx, "sse.broadcast unparseable spins", "error", err)
+		return
+	}
+	span.SetAttributes(attribute.Int("sse.spins", len(spins)))
+	if len(spins) == 0 {
+		return
+	}
+
+	publish(ctx, "spin", spinEvent{Type: "spin", Spins: spins})
 }
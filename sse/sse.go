@@ -0,0 +1,500 @@
+// Package sse serves server-sent event streams.
+//
+// A Hub numbers the events published to it, keeps the most recent ones, and
+// sends them to every connected client that subscribed to their type.
+// Clients that reconnect with a Last-Event-ID header are first sent the
+// events they missed, so a dropped connection doesn't lose anything still in
+// the history.
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
+)
+
+// Event is a server-sent event.
+type Event struct {
+	// Sent as the "id" field. IDs increase with every event published.
+	ID uint64
+	// Sent as the "event" field, e.g. "spin".
+	Type string
+	// Sent as the "data" field. It must be a single line, such as compact
+	// JSON.
+	Data []byte
+}
+
+// WriteTo writes the event in the text/event-stream format.
+func (e Event) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return int64(n), err
+}
+
+// SlowClientPolicy is what a Hub does when a client's queue is full, i.e.
+// the client reads events more slowly than they are published.
+type SlowClientPolicy string
+
+const (
+	// DropEvents skips the event for that client, which keeps its stream
+	// open but loses the event.
+	DropEvents SlowClientPolicy = "drop"
+	// Disconnect ends the client's stream. EventSource reconnects on its own
+	// with Last-Event-ID, so it is sent what it missed from the history.
+	Disconnect SlowClientPolicy = "disconnect"
+)
+
+// Valid reports whether p is a known policy.
+func (p SlowClientPolicy) Valid() bool {
+	return p == DropEvents || p == Disconnect
+}
+
+// Hub fans events out to the clients of one stream.
+//
+// A single goroutine owns the clients and the history. Publishing never waits
+// on a client: each client has its own bounded queue, and a client whose
+// queue is full is handled according to SlowClient. So one stalled
+// connection can't hold up the others, or the cache refresh that published
+// the event.
+type Hub struct {
+	// Number of events queued for each client.
+	ClientBuffer int
+	// What to do with a client whose queue is full. Defaults to Disconnect.
+	SlowClient SlowClientPolicy
+	// How long clients should wait before reconnecting, sent when they
+	// connect and when the stream is closed. 0 leaves it to the client.
+	Retry time.Duration
+	// How often a ": ping" comment is sent to otherwise idle clients, so
+	// that load balancers and mobile networks don't drop the connection as
+	// idle, and clients can tell the server is still there. 0 disables it.
+	Heartbeat time.Duration
+	// How long a stream may stay open before it is ended, give or take 10%
+	// so that clients who connected together don't all reconnect together.
+	// The client reconnects and catches up from the history. 0 means no
+	// limit.
+	MaxLifetime time.Duration
+	// Streams allowed at once per client IP. 0 means no limit.
+	MaxPerIP int
+	// The event types clients may subscribe to. Empty allows any.
+	Types []string
+
+	connsMu sync.Mutex     // to synchronize access to conns
+	conns   map[string]int // open streams by client IP
+
+	mu     sync.Mutex // so that events are queued in the order of their IDs
+	lastID uint64
+
+	publish     chan Event
+	subscribe   chan subscription
+	unsubscribe chan *client
+	clientCount atomic.Int64
+
+	// Only used by run.
+	clients map[*client]struct{}
+	history []Event // a ring buffer of the most recent events
+	next    int     // where the next event goes in history
+	full    bool    // whether history has wrapped around
+
+	startOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// client is a connected client's queue.
+type client struct {
+	ip string
+	// The event types the client subscribed to, or nil for all of them.
+	types  map[string]bool
+	events chan Event
+	// Closed by the hub when the client is disconnected for being slow.
+	kicked chan struct{}
+}
+
+// subscription asks the hub to register a client, and to send back the
+// events it missed since lastID (if resuming).
+type subscription struct {
+	client   *client
+	lastID   uint64
+	resuming bool
+	missed   chan []Event
+}
+
+// NewHub creates a Hub remembering the last historySize events for clients
+// that reconnect.
+//
+// IDs start from the current time in microseconds rather than 1, so that
+// they keep increasing across restarts: a client reconnecting to a new
+// process is sent that process's whole history, instead of nothing because
+// its Last-Event-ID is higher than every new ID.
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		ClientBuffer: 16,
+		SlowClient:   Disconnect,
+		lastID:       uint64(time.Now().UnixMicro()),
+		publish:      make(chan Event),
+		subscribe:    make(chan subscription),
+		unsubscribe:  make(chan *client),
+		conns:        make(map[string]int),
+		clients:      make(map[*client]struct{}),
+		history:      make([]Event, max(historySize, 0)),
+		closed:       make(chan struct{}),
+	}
+}
+
+// start runs the hub's goroutine, the first time anything needs it. Starting
+// it lazily lets the exported fields be set after NewHub.
+func (h *Hub) start() {
+	h.startOnce.Do(func() { go h.run() })
+}
+
+// run owns the clients and the history until the hub is closed.
+func (h *Hub) run() {
+	for {
+		select {
+		case <-h.closed:
+			return
+		case e := <-h.publish:
+			h.remember(e)
+			h.fanOut(e)
+		case sub := <-h.subscribe:
+			h.clients[sub.client] = struct{}{}
+			h.clientsChanged()
+			var missed []Event
+			if sub.resuming {
+				missed = h.since(sub.lastID, sub.client)
+			}
+			sub.missed <- missed
+		case c := <-h.unsubscribe:
+			delete(h.clients, c)
+			h.clientsChanged()
+		}
+	}
+}
+
+// wants reports whether c subscribed to events of type typ.
+func (c *client) wants(typ string) bool {
+	return c.types == nil || c.types[typ]
+}
+
+// fanOut queues e for every client subscribed to its type, without waiting
+// on any of them.
+func (h *Hub) fanOut(e Event) {
+	for c := range h.clients {
+		if !c.wants(e.Type) {
+			continue
+		}
+		select {
+		case c.events <- e:
+			continue
+		default:
+		}
+
+		metrics.SSEDroppedEvents.WithLabelValues(string(h.SlowClient)).Inc()
+		if h.SlowClient == DropEvents {
+			slog.Warn("sse.slow_client dropped event", "id", e.ID, "type", e.Type, "client_ip", c.ip)
+			continue
+		}
+		slog.Warn("sse.slow_client disconnected", "id", e.ID, "type", e.Type, "client_ip", c.ip)
+		delete(h.clients, c)
+		close(c.kicked)
+	}
+	h.clientsChanged()
+}
+
+func (h *Hub) clientsChanged() {
+	h.clientCount.Store(int64(len(h.clients)))
+	metrics.SSEClients.Set(float64(len(h.clients)))
+}
+
+// remember adds e to the history.
+func (h *Hub) remember(e Event) {
+	if len(h.history) == 0 {
+		return
+	}
+	h.history[h.next] = e
+	h.next = (h.next + 1) % len(h.history)
+	h.full = h.full || h.next == 0
+}
+
+// Publish queues an event of the given type for every client, and returns it
+// with its ID. It only waits for the hub's goroutine to take the event, which
+// never waits on clients, not for clients to receive it.
+func (h *Hub) Publish(ctx context.Context, typ string, data []byte) Event {
+	h.start()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	e := Event{ID: h.lastID, Type: typ, Data: data}
+	slog.InfoContext(ctx, "sse.publish", "type", typ, "id", e.ID, "clients", h.Len())
+	select {
+	case h.publish <- e:
+	case <-h.closed:
+	}
+	return e
+}
+
+// since returns the events in the history published after the one with the
+// given ID that c subscribed to, oldest first.
+func (h *Hub) since(id uint64, c *client) []Event {
+	var events []Event
+	if h.full {
+		events = append(events, h.history[h.next:]...)
+	}
+	events = append(events, h.history[:h.next]...)
+
+	var out []Event
+	for _, e := range events {
+		if e.ID > id && c.wants(e.Type) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Len returns the number of connected clients.
+func (h *Hub) Len() int {
+	return int(h.clientCount.Load())
+}
+
+// typeSet returns types as a set, or nil (meaning every type) if it is empty.
+func typeSet(types []string) map[string]bool {
+	if len(types) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(types))
+	for _, t := range types {
+		set[t] = true
+	}
+	return set
+}
+
+// lastEventID returns the ID a reconnecting client last received, from the
+// Last-Event-ID header that EventSource sends, if there is one.
+func lastEventID(r *http.Request) (uint64, bool) {
+	v := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if v == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// acquire counts a new stream from ip, and reports false if ip already has
+// MaxPerIP of them.
+func (h *Hub) acquire(ip string) bool {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	if h.MaxPerIP > 0 && h.conns[ip] >= h.MaxPerIP {
+		return false
+	}
+	h.conns[ip]++
+	return true
+}
+
+// release uncounts a stream from ip.
+func (h *Hub) release(ip string) {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	if h.conns[ip]--; h.conns[ip] <= 0 {
+		delete(h.conns, ip)
+	}
+}
+
+// lifetime returns how long a new stream may stay open, MaxLifetime give or
+// take up to 10%, or 0 if there is no limit.
+func (h *Hub) lifetime() time.Duration {
+	if h.MaxLifetime <= 0 {
+		return 0
+	}
+	jitter := h.MaxLifetime / 10
+	return h.MaxLifetime - jitter + rand.N(2*jitter+1)
+}
+
+// Types returns the event types r subscribes to, from its comma-separated
+// types query parameter (e.g. ?types=spin,show), or nil if it has none.
+func Types(r *http.Request) []string {
+	var types []string
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" && !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// ServeHTTP streams events of every type to the client, or of the types it
+// asks for with a types query parameter. See Stream.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, nil)
+}
+
+// Stream returns a handler like ServeHTTP, but streaming only events of the
+// given types to clients that don't ask for any.
+func (h *Hub) Stream(defaultTypes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, defaultTypes)
+	})
+}
+
+// writeError writes a JSON error, as the rest of the proxy does.
+func writeError(w http.ResponseWriter, status int, body map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// serve streams events to the client until it disconnects or the hub is
+// closed. A client sending Last-Event-ID is first sent the events it missed
+// that are still in the history.
+func (h *Hub) serve(w http.ResponseWriter, r *http.Request, defaultTypes []string) {
+	// Check if the client supports server-sent events via the http.Flusher
+	// interface. If it doesn't, return an error.
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	types := Types(r)
+	if types == nil {
+		types = defaultTypes
+	}
+	for _, t := range types {
+		if len(h.Types) > 0 && !slices.Contains(h.Types, t) {
+			writeError(w, http.StatusBadRequest, map[string]any{"error": "unknown event type " + t, "types": h.Types})
+			return
+		}
+	}
+
+	ip := clientip.FromRequest(r)
+	if !h.acquire(ip) {
+		slog.WarnContext(r.Context(), "sse.rejected too many connections", "client_ip", ip, "limit", h.MaxPerIP)
+		writeError(w, http.StatusTooManyRequests, map[string]any{"error": "too many connections", "limit": h.MaxPerIP})
+		return
+	}
+	defer h.release(ip)
+
+	// Register the client, and get the events it missed in the same step,
+	// so that none is missed or sent twice in between.
+	h.start()
+	c := &client{
+		ip:     ip,
+		types:  typeSet(types),
+		events: make(chan Event, max(h.ClientBuffer, 1)),
+		kicked: make(chan struct{}),
+	}
+	sub := subscription{client: c, missed: make(chan []Event, 1)}
+	sub.lastID, sub.resuming = lastEventID(r)
+	var missed []Event
+	select {
+	case h.subscribe <- sub:
+		missed = <-sub.missed
+		defer func() {
+			select {
+			case h.unsubscribe <- c:
+			case <-h.closed:
+			}
+			slog.InfoContext(r.Context(), "sse.disconnect", "clients", h.Len(), "client_ip", c.ip)
+		}()
+	case <-h.closed:
+	}
+	slog.InfoContext(r.Context(), "sse.connect", "clients", h.Len(), "client_ip", c.ip, "types", types,
+		"replayed", len(missed))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Send the headers now, so the client knows the stream is open before
+	// the first event, along with how long to wait before reconnecting if
+	// the connection drops.
+	if h.Retry > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", h.Retry.Milliseconds())
+	}
+	for _, e := range missed {
+		e.WriteTo(w)
+	}
+	flusher.Flush()
+
+	// A nil channel never fires, so heartbeats and the lifetime limit are
+	// simply off when not configured.
+	var heartbeat, expired <-chan time.Time
+	var ticker *time.Ticker
+	if h.Heartbeat > 0 {
+		ticker = time.NewTicker(h.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	if d := h.lifetime(); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			// Client closed connection
+			return
+		case <-h.closed:
+			// Tell the client why the stream ends and when to come back,
+			// rather than just cutting it off. Without a retry hint the
+			// client keeps its own, rather than reconnecting right away.
+			io.WriteString(w, "event: shutdown\n")
+			if h.Retry > 0 {
+				fmt.Fprintf(w, "retry: %d\n", h.Retry.Milliseconds())
+			}
+			io.WriteString(w, "data: server shutting down\n\n")
+			flusher.Flush()
+			return
+		case <-c.kicked:
+			// Too slow to keep up. The client reconnects and is sent what
+			// it missed from the history.
+			return
+		case <-expired:
+			// Same as above: the client reconnects and catches up.
+			slog.InfoContext(r.Context(), "sse.expired", "client_ip", c.ip)
+			return
+		case <-heartbeat:
+			_, err = io.WriteString(w, ": ping\n\n")
+		case e := <-c.events:
+			_, err = e.WriteTo(w)
+			// The stream isn't idle, so the next ping can wait.
+			if ticker != nil {
+				ticker.Reset(h.Heartbeat)
+			}
+		}
+		if err != nil {
+			// The connection is gone, even if the request context hasn't
+			// noticed yet.
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Close sends a final shutdown event to every client and ends their streams,
+// so that http.Server.Shutdown doesn't wait on them. It is safe to call more
+// than once.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		slog.Info("sse.shutdown", "clients", h.Len())
+		close(h.closed)
+	})
+}
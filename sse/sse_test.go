@@ -0,0 +1,321 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connect opens a stream from srv, sending lastID as Last-Event-ID if it
+// isn't empty. The caller must close the body before closing srv.
+func connect(t *testing.T, srv *httptest.Server, lastID string) *http.Response {
+	t.Helper()
+	return connectPath(t, srv, "/", lastID)
+}
+
+// connectPath is connect for a given path and query.
+func connectPath(t *testing.T, srv *httptest.Server, path, lastID string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// readEvents reads n events from r, without their trailing blank lines.
+func readEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+	var events []string
+	var lines []string
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		if line == "\n" {
+			events = append(events, strings.Join(lines, ""))
+			lines = nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return events
+}
+
+func TestHubReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		lastID func(ids []uint64) string
+		want   []int // the events sent before the live one
+	}{
+		{"new client", func([]uint64) string { return "" }, nil},
+		{"missed two", func(ids []uint64) string { return fmt.Sprint(ids[2]) }, []int{3, 4}},
+		{"up to date", func(ids []uint64) string { return fmt.Sprint(ids[4]) }, nil},
+		// Only the last 3 events are kept.
+		{"missed more than the history", func(ids []uint64) string { return fmt.Sprint(ids[0]) }, []int{2, 3, 4}},
+		{"invalid ID", func([]uint64) string { return "nope" }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub(3)
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			ctx := context.Background()
+			var ids []uint64
+			for i := range 5 {
+				e := h.Publish(ctx, "spin", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+				if len(ids) > 0 && e.ID <= ids[len(ids)-1] {
+					t.Fatalf("event IDs %v then %d; want them to increase", ids, e.ID)
+				}
+				ids = append(ids, e.ID)
+			}
+
+			resp := connect(t, srv, tt.lastID(ids))
+			defer resp.Body.Close()
+			live := h.Publish(ctx, "spin", []byte(`{"n":"live"}`))
+
+			var want []string
+			for _, i := range tt.want {
+				want = append(want, fmt.Sprintf("id: %d\nevent: spin\ndata: {\"n\":%d}\n", ids[i], i))
+			}
+			want = append(want, fmt.Sprintf("id: %d\nevent: spin\ndata: {\"n\":\"live\"}\n", live.ID))
+
+			got := readEvents(t, bufio.NewReader(resp.Body), len(want))
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("events = %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHubTypes(t *testing.T) {
+	h := NewHub(10)
+	h.Types = []string{"spin", "playlist", "show"}
+	mux := http.NewServeMux()
+	mux.Handle("/events", h)
+	mux.Handle("/spin-events", h.Stream("spin"))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	spin := h.Publish(ctx, "spin", []byte("1"))
+	show := h.Publish(ctx, "show", []byte("2"))
+	playlist := h.Publish(ctx, "playlist", []byte("3"))
+
+	tests := []struct {
+		path   string
+		missed []Event
+		live   []string // the types of live events received
+	}{
+		{"/events", []Event{show, playlist}, []string{"spin", "playlist", "show"}},
+		{"/events?types=show", []Event{show}, []string{"show"}},
+		{"/events?types=spin,%20playlist", []Event{playlist}, []string{"spin", "playlist"}},
+		{"/spin-events", nil, []string{"spin"}},
+		{"/spin-events?types=show", []Event{show}, []string{"show"}},
+	}
+	// Every client resumes from the spin, and then gets a live event of
+	// each type.
+	var resps []*http.Response
+	for _, tt := range tests {
+		resp := connectPath(t, srv, tt.path, fmt.Sprint(spin.ID))
+		defer resp.Body.Close()
+		resps = append(resps, resp)
+	}
+	live := make(map[string]Event)
+	for _, typ := range []string{"spin", "playlist", "show"} {
+		live[typ] = h.Publish(ctx, typ, []byte(`"live"`))
+	}
+
+	for i, tt := range tests {
+		events := tt.missed
+		for _, typ := range tt.live {
+			events = append(events, live[typ])
+		}
+		var want []string
+		for _, e := range events {
+			var b strings.Builder
+			e.WriteTo(&b)
+			want = append(want, strings.TrimSuffix(b.String(), "\n"))
+		}
+		if got := readEvents(t, bufio.NewReader(resps[i].Body), len(want)); strings.Join(got, "") != strings.Join(want, "") {
+			t.Errorf("%s: events = %q; want %q", tt.path, got, want)
+		}
+	}
+
+	resp := connectPath(t, srv, "/events?types=spin,weather", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown type: status %d; want 400", resp.StatusCode)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	h := NewHub(10)
+	h.Retry = 3 * time.Second
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp := connect(t, srv, "")
+	defer resp.Body.Close()
+
+	h.Close()
+	h.Close() // safe to call twice
+
+	// The stream starts with the retry directive and ends with the shutdown
+	// event.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "retry: 3000\n\nevent: shutdown\nretry: 3000\ndata: server shutting down\n\n"
+	if string(body) != want {
+		t.Errorf("stream = %q; want %q", body, want)
+	}
+
+	// Without a retry hint, none is sent on shutdown either, rather than
+	// "retry: 0".
+	h = NewHub(10)
+	srv = httptest.NewServer(h)
+	defer srv.Close()
+	resp = connect(t, srv, "")
+	defer resp.Body.Close()
+	h.Close()
+	if body, _ = io.ReadAll(resp.Body); string(body) != "event: shutdown\ndata: server shutting down\n\n" {
+		t.Errorf("stream without retry = %q", body)
+	}
+}
+
+func TestHubHeartbeat(t *testing.T) {
+	h := NewHub(10)
+	h.Heartbeat = 10 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp := connect(t, srv, "")
+	defer resp.Body.Close()
+
+	if got := readEvents(t, bufio.NewReader(resp.Body), 2); got[0] != ": ping\n" || got[1] != ": ping\n" {
+		t.Errorf("idle stream = %q; want pings", got)
+	}
+}
+
+func TestHubHeartbeatSkipsBusyStreams(t *testing.T) {
+	h := NewHub(10)
+	h.Heartbeat = 200 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp := connect(t, srv, "")
+	defer resp.Body.Close()
+
+	// Events come more often than heartbeats are due, so the stream is
+	// never idle long enough for a ping.
+	const n = 6
+	go func() {
+		for i := 0; i < n; i++ {
+			h.Publish(context.Background(), "spin", []byte("{}"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	for _, e := range readEvents(t, bufio.NewReader(resp.Body), n) {
+		if strings.HasPrefix(e, ":") {
+			t.Fatalf("busy stream got a heartbeat: %q", e)
+		}
+	}
+}
+
+func TestHubConnectionLimits(t *testing.T) {
+	h := NewHub(10)
+	h.MaxPerIP = 1
+	h.MaxLifetime = 50 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Test clients all connect from 127.0.0.1.
+	first := connect(t, srv, "")
+	defer first.Body.Close()
+	second := connect(t, srv, "")
+	defer second.Body.Close()
+	if second.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second stream from one address: status %d; want 429", second.StatusCode)
+	}
+
+	// The first stream ends on its own once its lifetime is up, which
+	// makes room for another.
+	done := make(chan struct{})
+	go func() {
+		io.ReadAll(first.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still open after its lifetime")
+	}
+	third := connect(t, srv, "")
+	defer third.Body.Close()
+	if third.StatusCode != http.StatusOK {
+		t.Errorf("stream after the first ended: status %d; want 200", third.StatusCode)
+	}
+}
+
+func TestHubSlowClient(t *testing.T) {
+	for _, policy := range []SlowClientPolicy{DropEvents, Disconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			h := NewHub(10)
+			h.SlowClient = policy
+			defer h.Close()
+
+			// subscribe registers a client that never reads, with room for
+			// one event. Once it returns, every event published before has
+			// been handed out.
+			subscribe := func() *client {
+				h.start()
+				c := &client{events: make(chan Event, 1), kicked: make(chan struct{})}
+				sub := subscription{client: c, missed: make(chan []Event, 1)}
+				h.subscribe <- sub
+				<-sub.missed
+				return c
+			}
+
+			c := subscribe()
+			// Publishing never waits on the stalled client.
+			for range 3 {
+				h.Publish(context.Background(), "spin", []byte("{}"))
+			}
+			subscribe()
+
+			if len(c.events) != 1 {
+				t.Errorf("client has %d queued events; want 1", len(c.events))
+			}
+			select {
+			case <-c.kicked:
+				if policy != Disconnect {
+					t.Error("slow client was disconnected")
+				}
+			default:
+				if policy == Disconnect {
+					t.Error("slow client is still connected")
+				}
+			}
+			if want := map[SlowClientPolicy]int{DropEvents: 2, Disconnect: 1}[policy]; h.Len() != want {
+				t.Errorf("Len() = %d; want %d", h.Len(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wbor-fm/spinitron-proxy/sse"
+)
+
+// readEvent returns the next event from r, without its trailing blank line.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		if line == "\n" {
+			return strings.Join(lines, "")
+		}
+		lines = append(lines, line)
+	}
+}
+
+// parseSpinEvent splits a spin event into its ID and data.
+func parseSpinEvent(t *testing.T, ev string) (uint64, spinEvent) {
+	t.Helper()
+	idField, rest, _ := strings.Cut(strings.TrimPrefix(ev, "id: "), "\n")
+	data, ok := strings.CutPrefix(rest, "event: spin\ndata: ")
+	id, err := strconv.ParseUint(idField, 10, 64)
+	if err != nil || !ok {
+		t.Fatalf("event = %q; want an id and event spin", ev)
+	}
+	var payload spinEvent
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		t.Fatalf("event data %q: %v", data, err)
+	}
+	return id, payload
+}
+
+func TestBroadcastSpinMessage(t *testing.T) {
+	eventHub = sse.NewHub(10)
+	defer eventHub.Close()
+	lastSpinID = 0
+
+	srv := httptest.NewServer(eventHub)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	// Only the newest spin is sent at first, then only spins newer than it.
+	ctx := context.Background()
+	BroadcastSpinMessage(ctx, []byte(`{"items": [{"id": 11, "song": "B"}, {"id": 10, "song": "A"}]}`))
+	BroadcastSpinMessage(ctx, []byte(`{"items": [{"id": 11, "song": "B"}, {"id": 10, "song": "A"}]}`))
+	BroadcastSpinMessage(ctx, []byte(`{"items": [{"id": 13, "song": "D"}, {"id": 12, "song": "C"}, {"id": 11, "song": "B"}]}`))
+
+	var lastID uint64
+	for _, songs := range [][]string{{"B"}, {"C", "D"}} {
+		id, payload := parseSpinEvent(t, readEvent(t, events))
+		if id <= lastID {
+			t.Fatalf("event id %d; want one above %d", id, lastID)
+		}
+		lastID = id
+
+		var got []string
+		for _, s := range payload.Spins {
+			got = append(got, s.Song)
+		}
+		if payload.Type != "spin" || strings.Join(got, ",") != strings.Join(songs, ",") {
+			t.Errorf("event data = %+v; want type spin with songs %v", payload, songs)
+		}
+	}
+}
+
+func TestBroadcastSpinMessageConcurrent(t *testing.T) {
+	eventHub = sse.NewHub(10)
+	eventHub.ClientBuffer = 100
+	defer eventHub.Close()
+	lastSpinID = 100
+
+	srv := httptest.NewServer(eventHub)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	// Refreshes racing each other, each seeing spins up to a different one.
+	const newest = 130
+	var wg sync.WaitGroup
+	for n := 101; n <= newest; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var items []string
+			for id := n; id > 100; id-- {
+				items = append(items, `{"id": `+strconv.Itoa(id)+`}`)
+			}
+			BroadcastSpinMessage(context.Background(), []byte(`{"items": [`+strings.Join(items, ",")+`]}`))
+		}()
+	}
+	wg.Wait()
+
+	// Every spin is sent once, in order, in events with increasing IDs.
+	var lastID uint64
+	next := int64(101)
+	for next <= newest {
+		id, payload := parseSpinEvent(t, readEvent(t, events))
+		if id <= lastID {
+			t.Fatalf("event id %d after %d; want increasing ids", id, lastID)
+		}
+		lastID = id
+		for _, s := range payload.Spins {
+			if s.ID != next {
+				t.Fatalf("got spin %d; want %d", s.ID, next)
+			}
+			next++
+		}
+	}
+}
+
+func TestBroadcastUpdate(t *testing.T) {
+	eventHub = sse.NewHub(10)
+	defer eventHub.Close()
+	currentPlaylist, currentShow = onAir{}, onAir{}
+
+	srv := httptest.NewServer(eventHub)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "?types=playlist,show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	// Only a change of playlist or show is sent, and spins aren't sent to a
+	// client that didn't ask for them.
+	ctx := context.Background()
+	BroadcastUpdate(ctx, "playlists", []byte(`{"items": [{"id": 2, "title": "Morning"}, {"id": 1}]}`))
+	BroadcastUpdate(ctx, "playlists", []byte(`{"items": [{"id": 2, "title": "Morning"}, {"id": 1}]}`))
+	BroadcastUpdate(ctx, "spins", []byte(`{"items": [{"id": 10}]}`))
+	BroadcastUpdate(ctx, "shows", []byte(`{"items": [{"id": 7, "title": "Jazz Hour"}, {"id": 8}]}`))
+	BroadcastUpdate(ctx, "personas", []byte(`{"items": [{"id": 3}]}`))
+
+	for _, want := range []string{
+		`event: playlist` + "\n" + `data: {"type":"playlist","playlist":{"id":2,`,
+		`event: show` + "\n" + `data: {"type":"show","show":{"id":7,`,
+	} {
+		if _, err := events.ReadString('\n'); err != nil { // the id line
+			t.Fatal(err)
+		}
+		event, _ := events.ReadString('\n')
+		data, _ := events.ReadString('\n')
+		events.ReadString('\n') // the blank line
+		if got := event + data; !strings.HasPrefix(got, want) {
+			t.Errorf("event = %q; want it to start with %q", got, want)
+		}
+	}
+}
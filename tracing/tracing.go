@@ -0,0 +1,106 @@
+// Package tracing sets up OpenTelemetry tracing, exported over OTLP/HTTP.
+//
+// Until Setup is called with tracing enabled, the global tracer provider is
+// OpenTelemetry's no-op one, so the spans started throughout the proxy cost
+// next to nothing.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wbor-fm/spinitron-proxy/clientip"
+	"github.com/wbor-fm/spinitron-proxy/logging"
+	"github.com/wbor-fm/spinitron-proxy/metrics"
+)
+
+// Name identifies the proxy's instrumentation to OpenTelemetry.
+const Name = "github.com/wbor-fm/spinitron-proxy"
+
+// Options configures Setup.
+type Options struct {
+	// Name reported as service.name, e.g. "spinitron-proxy".
+	ServiceName string
+	// OTLP/HTTP traces endpoint, e.g. "http://localhost:4318/v1/traces".
+	// Empty uses the standard OTEL_EXPORTER_OTLP_* environment variables,
+	// falling back to https://localhost:4318/v1/traces.
+	Endpoint string
+	// Fraction of traces to record, from 0 to 1. Requests that arrive with a
+	// sampled trace context are always recorded.
+	SampleRatio float64
+}
+
+// Setup installs a global tracer provider exporting spans to opts.Endpoint,
+// and the W3C trace context propagator. The returned function flushes any
+// buffered spans and shuts the provider down.
+func Setup(ctx context.Context, opts Options) (shutdown func(context.Context) error, err error) {
+	var exporterOpts []otlptracehttp.Option
+	if opts.Endpoint != "" {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(opts.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the proxy's tracer from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// of the caller if it sent a traceparent header. The span is named after the
+// method and route (see metrics.Route), and records the response status.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, r.Method+" "+metrics.Route(r.URL.Path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(clientip.FromRequest(r)),
+			),
+		)
+		defer span.End()
+
+		if id := logging.RequestID(ctx); id != "" {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+
+		rec := logging.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status()))
+		if rec.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status()))
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package tracing_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/wbor-fm/spinitron-proxy/cache"
+	"github.com/wbor-fm/spinitron-proxy/proxy"
+	"github.com/wbor-fm/spinitron-proxy/tracing"
+)
+
+// collector is an in-process stand-in for an OTLP/HTTP collector that keeps
+// every span it is sent.
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(out)
+}
+
+func (c *collector) byName() map[string]*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]*tracepb.Span)
+	for _, s := range c.spans {
+		out[s.Name] = s
+	}
+	return out
+}
+
+func TestSpansExportedOverOTLP(t *testing.T) {
+	col := &collector{}
+	colSrv := httptest.NewServer(col)
+	defer colSrv.Close()
+
+	shutdown, err := tracing.Setup(context.Background(), tracing.Options{
+		ServiceName: "test",
+		Endpoint:    colSrv.URL + "/v1/traces",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	c := &cache.Cache{TTLs: cache.NewTTLPolicy(cache.TTLTable{Default: time.Minute})}
+	c.Init()
+	h := tracing.Middleware(proxy.NewReverseProxy(target, "key", "example.org", c))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/spins", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d; want 200", rec.Code)
+	}
+
+	// Shutting down flushes the batched spans to the collector.
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := col.byName()
+	server, lookup, up := spans["GET /api/spins"], spans["cache.lookup"], spans["upstream GET"]
+	if server == nil || lookup == nil || up == nil {
+		t.Fatalf("collector got spans %v; want the request, cache.lookup and upstream GET", spans)
+	}
+
+	// The spans form a single trace: request > lookup > upstream.
+	if string(lookup.ParentSpanId) != string(server.SpanId) || string(up.ParentSpanId) != string(lookup.SpanId) {
+		t.Error("spans are not nested request > cache.lookup > upstream GET")
+	}
+	if traceparent == "" {
+		t.Error("upstream request carried no traceparent header")
+	}
+}